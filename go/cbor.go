@@ -4,20 +4,30 @@
 package cbor
 
 import (
+	"bufio"
 	"bytes"
+	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"math/big"
+	"net"
+	"net/netip"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var typeMask byte = 0xE0
-var infoBits byte = 0x1F
+const (
+	typeMask byte = 0xE0
+	infoBits byte = 0x1F
+)
 
 const (
 	MajorTypeUint   byte = 0
@@ -31,26 +41,44 @@ const (
 	MajorTypeFloat byte = MajorTypeSimple
 )
 
+// Values of the low 5 bits of an initial byte, beyond 0-23 which hold
+// the argument directly.
+const (
+	InfoUint8Follows  byte = 24
+	InfoUint16Follows byte = 25
+	InfoUint32Follows byte = 26
+	InfoUint64Follows byte = 27
+	InfoIndefinite    byte = 31
+)
+
 const (
-	SimpleValueFalse byte = 20
-	SimpleValueTrue  byte = iota
-	SimpleValueNull
-	SimpleValueUndefined
+	SimpleValueFalse     byte = 20
+	SimpleValueTrue      byte = 21
+	SimpleValueNull      byte = 22
+	SimpleValueUndefined byte = 23
 )
 
 const (
 	OpcodeBreak byte = 0x1F
 )
 
+// Split an initial byte into its major type (MajorTypeUint and so on)
+// and additional info.
+func SplitInitialByte(b byte) (major byte, info byte) {
+	return b >> 5, b & infoBits
+}
+
 /* type values */
-var cborUint byte = 0x00
-var cborNegint byte = 0x20
-var cborBytes byte = 0x40
-var cborText byte = 0x60
-var cborArray byte = 0x80
-var cborMap byte = 0xA0
-var cborTag byte = 0xC0
-var cbor7 byte = 0xE0
+const (
+	cborUint   byte = MajorTypeUint << 5
+	cborNegint byte = MajorTypeNegInt << 5
+	cborBytes  byte = MajorTypeBytes << 5
+	cborText   byte = MajorTypeText << 5
+	cborArray  byte = MajorTypeArray << 5
+	cborMap    byte = MajorTypeMap << 5
+	cborTag    byte = MajorTypeTag << 5
+	cbor7      byte = MajorTypeSimple << 5
+)
 
 /* cbor7 values */
 const (
@@ -60,30 +88,63 @@ const (
 )
 
 /* info bits */
-var int8Follows byte = 24
-var int16Follows byte = 25
-var int32Follows byte = 26
-var int64Follows byte = 27
-var varFollows byte = 31
+const (
+	int8Follows  = InfoUint8Follows
+	int16Follows = InfoUint16Follows
+	int32Follows = InfoUint32Follows
+	int64Follows = InfoUint64Follows
+	varFollows   = InfoIndefinite
+)
 
 /* tag values */
-var tagBignum uint64 = 2
-var tagNegBignum uint64 = 3
-var tagDecimal uint64 = 4
-var tagBigfloat uint64 = 5
+const (
+	tagDateTime  uint64 = 0
+	tagEpochTime uint64 = 1
+	tagBignum    uint64 = 2
+	tagNegBignum uint64 = 3
+	tagDecimal   uint64 = 4
+	tagBigfloat  uint64 = 5
+	tagURI       uint64 = 32
+	tagUUID      uint64 = 37
+	tagSet       uint64 = 258
+)
 
 /* batch sizes */
-var byteBatch = 1 << 20
-var arrayBatch = 1 << 14 //16k
+const (
+	byteBatch  = 1 << 20
+	smallBytes = 4 << 10
+	arrayBatch = 1 << 14 //16k
+)
 
 // TODO: honor encoding.BinaryMarshaler interface and encapsulate blob returned from that.
 
-// Load one object into v
+// Load one object into v. Empty input leaves v untouched and returns an
+// error wrapping io.EOF, so errors.Is(err, io.EOF) tells it apart from
+// input which ends part way through the item, io.ErrUnexpectedEOF.
 func Loads(blob []byte, v interface{}) error {
+	if len(blob) == 0 {
+		return fmt.Errorf("empty input: %w", io.EOF)
+	}
 	dec := NewDecoder(bytes.NewReader(blob))
 	return dec.Decode(v)
 }
 
+// Load the first object in data into v, returning the bytes after it,
+// e.g. for CBOR embedded in a larger binary format. Loads ignores them.
+func UnmarshalFirst(data []byte, v interface{}) (rest []byte, err error) {
+	// a bytes.Reader is an io.ByteReader, so nothing is read ahead
+	dec := NewDecoder(bytes.NewReader(data))
+	err = dec.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return data[dec.BytesRead():], nil
+}
+
+// ErrUnsupportedType is returned, wrapped with details, for a well-formed
+// item which has no Go equivalent, such as an unassigned simple value.
+var ErrUnsupportedType = errors.New("cbor: unsupported simple/float value")
+
 type TagDecoder interface {
 	// Handle things which match this.
 	//
@@ -102,33 +163,345 @@ type TagDecoder interface {
 	PostDecode(interface{}) (interface{}, error)
 }
 
-type Decoder struct {
-	reader io.Reader
+// TagEncoder writes values of a Go type as a tagged item, see
+// Encoder.TagEncoders.
+type TagEncoder interface {
+	GetTag() uint64
+
+	// Return what to encode as the tag's content in place of v.
+	PreEncode(v interface{}) (interface{}, error)
+}
+
+// RawTagDecoder may be implemented by a TagDecoder which needs the exact
+// encoding of the tagged item, e.g. to check a signature over it. When
+// it is, DecodeTarget and PostDecode aren't called; DecodeRaw gets the
+// undecoded bytes of the item following the tag number, and its return
+// value is used as the value of the tag.
+type RawTagDecoder interface {
+	DecodeRaw(raw []byte) (interface{}, error)
+}
+
+// UnmarshallValue is implemented by types which populate themselves, e.g.
+// through setters or a constructor, instead of by reflection. The CBOR
+// item is first decoded as into an interface{} (maps become
+// map[interface{}]interface{}, arrays []interface{}, and so on) and handed
+// to FromCBOR.
+//
+// It takes precedence over every other way of decoding into the type,
+// including encoding.TextUnmarshaler and struct field assignment, wherever
+// the type appears: at the top level, as a struct field, map value or
+// array element. A null for a pointer to such a type still sets nil.
+type UnmarshallValue interface {
+	FromCBOR(v interface{}) error
+}
+
+var unmarshallValueType = reflect.TypeOf((*UnmarshallValue)(nil)).Elem()
 
-	// tag byte
-	tag []byte
+type Decoder struct {
+	reader *countingReader
 
 	// many values fit within the next 8 bytes
 	b8 []byte
 
 	// Extra processing for CBOR TAG objects.
 	TagDecoders map[uint64]TagDecoder
+
+	// Tags without a TagDecoder which are stripped, decoding the tagged
+	// item directly into the target instead of into a CBORTag.
+	TransparentTags map[uint64]bool
+
+	// Strip every tag without a TagDecoder, as for TransparentTags.
+	UnwrapUnknownTags bool
+
+	// Decode tag 258, an array marked as a set, into a map[T]struct{}
+	// holding its elements, or as a plain array into anything else such
+	// as a slice or an interface{}. A TagDecoder for 258 takes
+	// precedence.
+	DecodeSets bool
+
+	// Called with the number of every tag decoded, whether or not it has
+	// a TagDecoder, e.g. to audit which tags appear in a message. Values
+	// passed over by Skip or as unknown struct fields aren't reported.
+	OnTag func(tag uint64)
+
+	// Decode numbers into an interface{} as a Number rather than as
+	// uint64, int64, float32, float64 or big.Int.
+	UseNumber bool
+
+	// Which Go type integers decoded into an interface{} get.
+	IntDecodeMode IntDecodeMode
+
+	// Which Go type floats decoded into an interface{} get.
+	FloatDecodeMode FloatDecodeMode
+
+	// Reject indefinite-length byte strings, text strings, arrays and
+	// maps, and integers, lengths and tag numbers not written in their
+	// shortest form, as deterministic encoding profiles require.
+	Strict bool
+
+	// Match map keys to struct field names exactly. By default case is
+	// ignored, so "UserID" and "userid" both fill the same field.
+	CaseSensitiveFields bool
+
+	// Return an error for map keys which match no field of the struct
+	// being decoded into, rather than skipping their values.
+	DisallowUnknownFields bool
+
+	// Refuse byte string keys for maps with string keys and for structs,
+	// rather than converting the bytes to a string which may not be
+	// valid UTF-8.
+	RejectByteStringKeys bool
+
+	// Maximum number of array and map entries decoded across one item,
+	// counting nested collections. Zero means no limit.
+	MaxElements int
+
+	// Maximum declared length of a byte string, text string, array or
+	// map. Zero means no limit, though lengths which don't fit in an
+	// int are always rejected.
+	MaxLen int
+
+	// Constructors for interface types, see RegisterInterface.
+	interfaceFactories map[reflect.Type]func() interface{}
+
+	// collection entries seen so far in the current item
+	elements int
+
+	// decode maps into an interface{} as an OrderedMap, keeping byte
+	// string and duplicate keys apart while converting to JSON
+	orderedMaps bool
+
+	// initial byte read by PeekType, returned by the next readByte
+	peeked     bool
+	peekedByte byte
+
+	// scratch space for reading short text strings, see readText
+	textBuf []byte
+
+	// the buffer NewDecoder wrapped the reader in, reused by Reset
+	bufr *bufio.Reader
+	// whether r is buffered, i.e. the decoder came from NewDecoder
+	buffered bool
 }
 
+// NewDecoder reads from r, wrapping it in a bufio.Reader unless it already
+// implements io.ByteReader, since decoding makes many tiny reads. The
+// buffer may read past the last item decoded; use NewUnbufferedDecoder if
+// r is shared with other readers.
 func NewDecoder(r io.Reader) *Decoder {
+	var bufr *bufio.Reader
+	if _, ok := r.(io.ByteReader); !ok {
+		bufr = bufio.NewReader(r)
+		r = bufr
+	}
+	dec := NewUnbufferedDecoder(r)
+	dec.bufr = bufr
+	dec.buffered = true
+	return dec
+}
+
+// Reset makes the decoder read from r as if it were new, keeping its
+// options, TagDecoders and scratch space, e.g. to pool decoders in a
+// sync.Pool. A decoder from NewDecoder wraps r in a buffer as NewDecoder
+// would, reusing the one it already has.
+func (dec *Decoder) Reset(r io.Reader) {
+	if _, ok := r.(io.ByteReader); !ok && dec.buffered {
+		if dec.bufr == nil {
+			dec.bufr = bufio.NewReader(r)
+		} else {
+			dec.bufr.Reset(r)
+		}
+		r = dec.bufr
+	}
+	br, _ := r.(io.ByteReader)
+	*dec.reader = countingReader{r: r, br: br}
+	dec.elements = 0
+	dec.peeked = false
+}
+
+// NewUnbufferedDecoder reads from r exactly as many bytes as each item
+// needs, for callers which manage their own buffering.
+func NewUnbufferedDecoder(r io.Reader) *Decoder {
 	return &Decoder{
-		reader:      r,
-		tag:         make([]byte, 1),
-		b8:          make([]byte, 8),
-		TagDecoders: make(map[uint64]TagDecoder),
+		reader: newCountingReader(r),
+		b8:     make([]byte, 8),
+		TagDecoders: map[uint64]TagDecoder{
+			tagDecimal: decimalTagDecoder{},
+			tagUUID:    uuidTagDecoder{},
+		},
+		TransparentTags: make(map[uint64]bool),
 	}
 }
+
+// Decode reads the next CBOR item from the stream into v. Items written
+// back to back, as by repeated Encoder.Encode calls, are read one per call;
+// io.EOF is returned once the stream ends cleanly between items.
 func (dec *Decoder) Decode(v interface{}) error {
 	rv := reflect.ValueOf(v)
 
-	return dec.DecodeAny(newReflectValue(rv))
+	return dec.DecodeAny(&reflectValue{v: rv, dec: dec})
+}
+
+// DecodeReflect is Decode for callers which already hold a reflect.Value.
+// rv must either be settable, as a field reached through a pointer is, or
+// be a non-nil pointer, in which case the item is decoded into what it
+// points to.
+func (dec *Decoder) DecodeReflect(rv reflect.Value) error {
+	if !rv.IsValid() {
+		return &InvalidUnmarshalError{nil}
+	}
+	if !rv.CanSet() && (rv.Kind() != reflect.Ptr || rv.IsNil()) {
+		return &InvalidUnmarshalError{rv.Type()}
+	}
+	return dec.DecodeAny(&reflectValue{v: rv, dec: dec})
+}
+
+// Register a constructor used when decoding into a nil interface value of
+// the type pointed to by ifacePtr. The factory must return a pointer
+// implementing the interface; the CBOR item is decoded into it.
+//
+//	dec.RegisterInterface((*Shape)(nil), func() interface{} { return &Circle{} })
+//
+// Without a factory, decoding into a non-empty interface type only works
+// if the decoded value happens to implement it, else an error is returned.
+func (dec *Decoder) RegisterInterface(ifacePtr interface{}, factory func() interface{}) {
+	if dec.interfaceFactories == nil {
+		dec.interfaceFactories = make(map[reflect.Type]func() interface{})
+	}
+	dec.interfaceFactories[reflect.TypeOf(ifacePtr).Elem()] = factory
+}
+
+// Decode items under the given tag into a fresh value of the type of
+// prototype, e.g. a MyEvent for
+//
+//	dec.RegisterTagType(1000, MyEvent{})
+//
+// rather than into a CBORTag, without writing a TagDecoder for the type.
+// A pointer prototype yields a pointer. This installs a TagDecoder,
+// replacing any already set for the tag. A nil prototype, which has no
+// type, is an error.
+func (dec *Decoder) RegisterTagType(tag uint64, prototype interface{}) error {
+	if prototype == nil {
+		return fmt.Errorf("cbor: nil prototype for tag %d", tag)
+	}
+	if dec.TagDecoders == nil {
+		dec.TagDecoders = make(map[uint64]TagDecoder)
+	}
+	dec.TagDecoders[tag] = typeTagDecoder{tag: tag, typ: reflect.TypeOf(prototype)}
+	return nil
+}
+
+// TagDecoder made by RegisterTagType.
+type typeTagDecoder struct {
+	tag uint64
+	typ reflect.Type
+}
+
+func (td typeTagDecoder) GetTag() uint64 { return td.tag }
+
+func (td typeTagDecoder) DecodeTarget() interface{} { return reflect.New(td.typ).Interface() }
+
+func (td typeTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	return reflect.ValueOf(v).Elem().Interface(), nil
+}
+
+// Read a CBOR sequence (RFC 8742) of len(items) items, decoding each one
+// into the corresponding target.
+func (dec *Decoder) DecodeSequence(items ...interface{}) error {
+	for _, item := range items {
+		err := dec.Decode(item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeArrayIter reads the header of a CBOR array and returns a function
+// which decodes the next element into v on each call, so arrays too large
+// to hold in memory can be processed one element at a time. v is reset to
+// its zero value before each element. The function returns false once the
+// array is exhausted. Both definite and indefinite-length arrays work.
+//
+//	next, err := dec.DecodeArrayIter(&rec)
+//	ok, err := next()
+//	for ; ok; ok, err = next() {
+//		// use rec
+//	}
+//	// check err
+func (dec *Decoder) DecodeArrayIter(v interface{}) (func() (bool, error), error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	c, err := dec.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if c&typeMask != cborArray {
+		return nil, fmt.Errorf("expected an array, got major type %d", c>>5)
+	}
+	cborInfo := c & infoBits
+	aux, err := dec.handleInfoBits(cborInfo)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	indefinite := cborInfo == varFollows
+	if dec.Strict && indefinite {
+		return nil, fmt.Errorf("indefinite-length item of type %x not allowed in strict mode", cborArray)
+	}
+	err = dec.checkMinimal(cborArray, cborInfo, aux)
+	if err != nil {
+		return nil, err
+	}
+
+	done := false
+	next := func() (bool, error) {
+		if done {
+			return false, nil
+		}
+		var c byte
+		if indefinite {
+			c, err = dec.readByte()
+			if err == nil && c == 0xff {
+				done = true
+				return false, nil
+			}
+		} else {
+			if aux == 0 {
+				done = true
+				return false, nil
+			}
+			aux--
+			c, err = dec.readByte()
+		}
+		if err == nil {
+			rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+			dec.elements = 0
+			err = dec.innerDecodeC(&reflectValue{v: rv, dec: dec}, c)
+		}
+		if err != nil {
+			done = true
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	return next, nil
 }
 
+// DecodeValue receives a decoded item. Decode wraps its target in one
+// which assigns through reflection; pass your own to DecodeInto to decode
+// into other storage, e.g. preallocated arena slots, without the
+// per-element allocations of reflect.New. Its CreateMap and CreateArray
+// return the DecodeValueMap and DecodeValueArray which receive the
+// entries, so custom storage can cover nested items as well.
 type DecodeValue interface {
 	// Before decoding, check if there is no error
 	Prepare() error
@@ -169,7 +542,7 @@ type DecodeValueMap interface {
 	// Got a map key
 	CreateMapKey() (DecodeValue, error)
 
-	// Got a map value
+	// Got a map value. A nil DecodeValue with no error skips the value.
 	CreateMapValue(key DecodeValue) (DecodeValue, error)
 
 	// Got a key / value pair
@@ -192,6 +565,24 @@ type DecodeValueArray interface {
 
 type reflectValue struct {
 	v reflect.Value
+
+	// options and registries; nil for defaults
+	dec *Decoder
+
+	// struct field with the ",string" option, a number or bool may
+	// arrive as a text string
+	quoted bool
+
+	// key of a map or struct, see Decoder.RejectByteStringKeys
+	mapKey bool
+
+	// struct field with the ",pairs" option, a map may arrive as an
+	// array of alternating keys and values
+	pairs bool
+
+	// content of a set tag, see Decoder.DecodeSets; a map[T]struct{}
+	// may arrive as an array of its keys
+	set bool
 }
 
 type MemoryValue struct {
@@ -201,7 +592,7 @@ type MemoryValue struct {
 
 func NewMemoryValue(value interface{}) *MemoryValue {
 	res := &MemoryValue{
-		reflectValue{reflect.ValueOf(nil)},
+		reflectValue{v: reflect.ValueOf(nil)},
 		value,
 	}
 	res.v = reflect.ValueOf(&res.Value)
@@ -213,7 +604,12 @@ func (mv *MemoryValue) ReflectValue() reflect.Value {
 }
 
 func newReflectValue(rv reflect.Value) *reflectValue {
-	return &reflectValue{rv}
+	return &reflectValue{v: rv}
+}
+
+// A reflectValue for a value nested inside this one, sharing its Decoder.
+func (r *reflectValue) child(rv reflect.Value) *reflectValue {
+	return &reflectValue{v: rv, dec: r.dec}
 }
 
 func (r *reflectValue) Prepare() error {
@@ -221,85 +617,548 @@ func (r *reflectValue) Prepare() error {
 	if (!rv.CanSet()) && (rv.Kind() != reflect.Ptr || rv.IsNil()) {
 		return &InvalidUnmarshalError{rv.Type()}
 	}
+	return r.useFactory()
+}
+
+// If the target is a nil interface with a factory registered on the
+// Decoder, fill it from the factory and decode into the new value.
+func (r *reflectValue) useFactory() error {
+	if r.dec == nil || r.dec.interfaceFactories == nil {
+		return nil
+	}
+	rv := r.v
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Interface || !rv.IsNil() || !rv.CanSet() {
+		return nil
+	}
+	factory := r.dec.interfaceFactories[rv.Type()]
+	if factory == nil {
+		return nil
+	}
+	fv := reflect.ValueOf(factory())
+	if fv.Kind() != reflect.Ptr || fv.IsNil() || !fv.Type().Implements(rv.Type()) {
+		return fmt.Errorf("factory for %s must return a non-nil pointer implementing it, got %s", rv.Type().String(), fv.Type().String())
+	}
+	rv.Set(fv)
+	r.v = fv
 	return nil
 }
 
-func (dec *Decoder) DecodeAny(v DecodeValue) error {
-	var err error
+// Store x in an interface target, refusing values which don't implement
+// a non-empty interface type rather than panicking.
+func setInterface(rv reflect.Value, x reflect.Value) error {
+	if !x.Type().AssignableTo(rv.Type()) {
+		return fmt.Errorf("cannot assign %s into interface type %s", x.Type().String(), rv.Type().String())
+	}
+	rv.Set(x)
+	return nil
+}
 
-	_, err = io.ReadFull(dec.reader, dec.tag)
-	if err != nil {
-		return err
+// A SyntaxError reports input which is not well-formed CBOR.
+type SyntaxError struct {
+	msg string
+
+	// bytes read from the input when the error was detected
+	Offset int64
+}
+
+func (e *SyntaxError) Error() string {
+	return e.msg
+}
+
+// A TagContentError reports a tag whose content is well-formed CBOR but
+// not what the tag requires, such as a bignum holding a text string. It
+// also matches *SyntaxError with errors.As, as invalid input.
+type TagContentError struct {
+	Tag uint64
+	msg string
+
+	// bytes read from the input when the error was detected
+	Offset int64
+}
+
+func (e *TagContentError) Error() string {
+	return fmt.Sprintf("tag %d: %s", e.Tag, e.msg)
+}
+
+// As lets errors.As find a *SyntaxError with the same message and offset.
+func (e *TagContentError) As(target interface{}) bool {
+	se, ok := target.(**SyntaxError)
+	if !ok {
+		return false
 	}
+	*se = &SyntaxError{msg: e.Error(), Offset: e.Offset}
+	return true
+}
 
-	if err := v.Prepare(); err != nil {
-		return err
+func (dec *Decoder) tagContentError(tag uint64, format string, args ...interface{}) error {
+	return &TagContentError{Tag: tag, msg: fmt.Sprintf(format, args...), Offset: dec.BytesRead()}
+}
+
+// Check the initial byte c of the content of a standard tag against what
+// the tag requires, unless a TagDecoder other than a built-in one handles
+// the tag and so decides what it accepts. Bignums are checked by
+// decodeBignum.
+func (dec *Decoder) checkTagContent(tag uint64, c byte) error {
+	if td, ok := dec.TagDecoders[tag]; ok && !isStandardTagDecoder(td) {
+		return nil
+	}
+	cborType := c & typeMask
+	cborInfo := c & infoBits
+	switch tag {
+	case tagDateTime, tagURI:
+		if cborType != cborText {
+			return dec.tagContentError(tag, "must hold a text string, got major type %d", cborType>>5)
+		}
+	case tagEpochTime:
+		isFloat := cborType == cbor7 && cborInfo >= int16Follows && cborInfo <= int64Follows
+		if cborType != cborUint && cborType != cborNegint && !isFloat {
+			return dec.tagContentError(tag, "must hold an integer or float, got initial byte %#x", c)
+		}
+	case tagDecimal, tagBigfloat:
+		if cborType != cborArray {
+			return dec.tagContentError(tag, "must hold an array, got major type %d", cborType>>5)
+		}
+	case tagUUID:
+		if cborType != cborBytes {
+			return dec.tagContentError(tag, "must hold a byte string, got major type %d", cborType>>5)
+		}
+		// longer length forms are checked once read
+		if cborInfo < int8Follows && cborInfo != 16 {
+			return dec.tagContentError(tag, "must hold 16 bytes, got %d", cborInfo)
+		}
 	}
+	return nil
+}
 
-	return dec.innerDecodeC(v, dec.tag[0])
+func (dec *Decoder) syntaxError(format string, args ...interface{}) error {
+	return &SyntaxError{msg: fmt.Sprintf(format, args...), Offset: dec.BytesRead()}
 }
 
-func (dec *Decoder) handleInfoBits(cborInfo byte) (uint64, error) {
-	var aux uint64
+// An UnmarshalTypeError reports a CBOR item which can't be stored in the
+// Go type it is being decoded into, such as a bool into an int.
+type UnmarshalTypeError struct {
+	Value string       // description of the CBOR item: "bool", "string", ...
+	Type  reflect.Type // type it couldn't be assigned to
 
-	if cborInfo <= 23 {
-		aux = uint64(cborInfo)
-		return aux, nil
-	} else if cborInfo == int8Follows {
-		didread, err := io.ReadFull(dec.reader, dec.b8[:1])
-		if didread == 1 {
-			aux = uint64(dec.b8[0])
-		}
-		return aux, err
-	} else if cborInfo == int16Follows {
-		didread, err := io.ReadFull(dec.reader, dec.b8[:2])
-		if didread == 2 {
-			aux = (uint64(dec.b8[0]) << 8) | uint64(dec.b8[1])
+	// bytes read from the input when the error was detected
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return "cannot assign " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+// typeError reports that a value described by what can't be stored in
+// the target.
+func (r *reflectValue) typeError(what string) error {
+	var offset int64
+	if r.dec != nil {
+		offset = r.dec.BytesRead()
+	}
+	return &UnmarshalTypeError{Value: what, Type: r.v.Type(), Offset: offset}
+}
+
+// PeekType returns the major type (MajorTypeUint and so on) of the next
+// item without consuming it, e.g. to choose what to decode a union into.
+// The following Decode, Skip or PeekType still sees the whole item. The
+// byte read to find the type is already counted by BytesRead.
+func (dec *Decoder) PeekType() (byte, error) {
+	if !dec.peeked {
+		c, err := dec.readByte()
+		if err != nil {
+			return 0, err
 		}
-		return aux, err
-	} else if cborInfo == int32Follows {
-		didread, err := io.ReadFull(dec.reader, dec.b8[:4])
-		if didread == 4 {
-			aux = (uint64(dec.b8[0]) << 24) |
-				(uint64(dec.b8[1]) << 16) |
-				(uint64(dec.b8[2]) << 8) |
-				uint64(dec.b8[3])
+		dec.peekedByte = c
+		dec.peeked = true
+	}
+	major, _ := SplitInitialByte(dec.peekedByte)
+	return major, nil
+}
+
+// Number of bytes consumed from the underlying reader so far. After a
+// failed Decode this is where reading stopped, inside the bad item.
+func (dec *Decoder) BytesRead() int64 {
+	return dec.reader.n
+}
+
+// io.Reader which counts what is read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+
+	// r as an io.ByteReader if it is one, for single byte reads
+	br io.ByteReader
+
+	// if set, everything read is also copied here
+	capture *bytes.Buffer
+}
+
+func newCountingReader(r io.Reader) *countingReader {
+	br, _ := r.(io.ByteReader)
+	return &countingReader{r: r, br: br}
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.capture != nil {
+		cr.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+// readByte reads one byte, directly through io.ByteReader when available
+// as the many single byte reads dominate decoding small items.
+func (dec *Decoder) readByte() (byte, error) {
+	if dec.peeked {
+		dec.peeked = false
+		return dec.peekedByte, nil
+	}
+	cr := dec.reader
+	if cr.br != nil {
+		b, err := cr.br.ReadByte()
+		if err != nil {
+			return 0, err
 		}
-		return aux, err
-	} else if cborInfo == int64Follows {
-		didread, err := io.ReadFull(dec.reader, dec.b8)
-		if didread == 8 {
-			var shift uint = 56
-			i := 0
-			aux = uint64(dec.b8[i]) << shift
-			for i < 7 {
-				i += 1
-				shift -= 8
-				aux |= uint64(dec.b8[i]) << shift
-			}
+		cr.n++
+		if cr.capture != nil {
+			cr.capture.WriteByte(b)
 		}
-		return aux, err
+		return b, nil
 	}
-	return 0, nil
+	_, err := io.ReadFull(cr, dec.b8[:1])
+	return dec.b8[0], err
 }
 
-func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
-	cborType := c & typeMask
-	cborInfo := c & infoBits
+// Read the next CBOR item into v. Returns io.EOF only if the stream ended
+// before the item started, and io.ErrUnexpectedEOF if it ended part way
+// through the item.
+func (dec *Decoder) DecodeAny(v DecodeValue) error {
+	c, err := dec.readByte()
+	if err != nil {
+		return err
+	}
 
-	aux, err := dec.handleInfoBits(cborInfo)
+	dec.elements = 0
+	err = dec.innerDecodeC(v, c)
+	if err == io.EOF {
+		// the item was started, so running out now is a truncation
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DecodeInto reads the next CBOR item into dv, a caller's own DecodeValue,
+// e.g. one writing into preallocated storage. Errors are as for DecodeAny.
+func (dec *Decoder) DecodeInto(dv DecodeValue) error {
+	return dec.DecodeAny(dv)
+}
+
+// decodeItem reads a nested item, sharing the limits of the enclosing
+// DecodeAny.
+func (dec *Decoder) decodeItem(v DecodeValue) error {
+	c, err := dec.readByte()
 	if err != nil {
-		log.Printf("error in handleInfoBits: %v", err)
 		return err
 	}
-	//log.Printf("cborType %x cborInfo %d aux %x", cborType, cborInfo, aux)
+	return dec.innerDecodeC(v, c)
+}
 
-	if cborType == cborUint {
-		return rv.SetUint(aux)
-	} else if cborType == cborNegint {
-		if aux > 0x7fffffffffffffff {
-			//return errors.New(fmt.Sprintf("cannot represent -%d", aux))
-			bigU := &big.Int{}
+// Skip past the next CBOR item, including everything nested inside it,
+// without building any Go values. Returns io.EOF only if the stream ended
+// before the item started, like DecodeAny. MaxLen, MaxElements and Strict
+// apply as they do when decoding.
+func (dec *Decoder) Skip() error {
+	c, err := dec.readByte()
+	if err != nil {
+		return err
+	}
+	dec.elements = 0
+	err = dec.skipItem(c)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (dec *Decoder) skipItem(c byte) error {
+	cborType := c & typeMask
+	cborInfo := c & infoBits
+
+	if c == 0xff {
+		return dec.syntaxError("unexpected break where an item should be")
+	}
+
+	aux, err := dec.handleInfoBits(cborInfo)
+	if err != nil {
+		return err
+	}
+	indefinite := cborInfo == varFollows && cborType != cbor7
+	if dec.Strict && indefinite {
+		return fmt.Errorf("indefinite-length item of type %x not allowed in strict mode", cborType)
+	}
+	err = dec.checkMinimal(cborType, cborInfo, aux)
+	if err != nil {
+		return err
+	}
+
+	switch cborType {
+	case cborBytes, cborText:
+		if !indefinite {
+			n, err := dec.checkLen(aux)
+			if err != nil {
+				return err
+			}
+			copied, err := io.CopyN(io.Discard, dec.reader, int64(n))
+			if copied < int64(n) && (err == nil || err == io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		for {
+			chunk, err := dec.readByte()
+			if err != nil {
+				return err
+			}
+			if chunk == 0xff {
+				return nil
+			}
+			err = dec.checkChunk(chunk, cborType)
+			if err != nil {
+				return err
+			}
+			err = dec.skipItem(chunk)
+			if err != nil {
+				return err
+			}
+		}
+	case cborArray:
+		return dec.skipItems(aux, indefinite, 1)
+	case cborMap:
+		return dec.skipItems(aux, indefinite, 2)
+	case cborTag:
+		inner, err := dec.readByte()
+		if err != nil {
+			return err
+		}
+		return dec.skipItem(inner)
+	}
+	// integers, floats and simple values are done once their
+	// argument has been read
+	return nil
+}
+
+// captureItem reads the rest of the item starting with c and returns
+// its encoding, c included.
+func (dec *Decoder) captureItem(c byte) ([]byte, error) {
+	cr := dec.reader
+	outer := cr.capture
+	buf := &bytes.Buffer{}
+	buf.WriteByte(c)
+	cr.capture = buf
+	err := dec.skipItem(c)
+	cr.capture = outer
+	if outer != nil {
+		// an enclosing capture needs these bytes too
+		outer.Write(buf.Bytes()[1:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// skipItems skips n entries of per items each, one for an array and two
+// for a map, or if indefinite every entry up to the break.
+func (dec *Decoder) skipItems(n uint64, indefinite bool, per int) error {
+	if !indefinite {
+		if _, err := dec.checkLen(n); err != nil {
+			return err
+		}
+		if err := dec.countElements(n); err != nil {
+			return err
+		}
+	}
+	for i := uint64(0); indefinite || i < n; i++ {
+		for k := 0; k < per; k++ {
+			c, err := dec.readByte()
+			if err != nil {
+				return err
+			}
+			if indefinite && c == 0xff {
+				if k != 0 {
+					return dec.syntaxError("break between a map key and its value")
+				}
+				return nil
+			}
+			if indefinite && k == 0 {
+				if err := dec.countElements(1); err != nil {
+					return err
+				}
+			}
+			err = dec.skipItem(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkLen validates a declared string or collection length and
+// returns it as an int.
+func (dec *Decoder) checkLen(n uint64) (int, error) {
+	if n > math.MaxInt {
+		return 0, fmt.Errorf("cbor: length %d overflows int", n)
+	}
+	if dec.MaxLen > 0 && n > uint64(dec.MaxLen) {
+		return 0, fmt.Errorf("cbor: length %d exceeds MaxLen %d", n, dec.MaxLen)
+	}
+	return int(n), nil
+}
+
+// countElements charges n collection entries against MaxElements.
+func (dec *Decoder) countElements(n uint64) error {
+	if dec.MaxElements <= 0 {
+		return nil
+	}
+	if n > uint64(dec.MaxElements-dec.elements) {
+		return fmt.Errorf("cbor: document exceeds %d collection elements", dec.MaxElements)
+	}
+	dec.elements += int(n)
+	return nil
+}
+
+// In strict mode, return a SyntaxError if the argument aux of an item of
+// major type cborType took more bytes than needed, e.g. 0x18 0x05 for the
+// integer 5. Floats, which share the widths, are exempt.
+func (dec *Decoder) checkMinimal(cborType, cborInfo byte, aux uint64) error {
+	if !dec.Strict || cborType == cbor7 {
+		return nil
+	}
+	var minimal bool
+	switch cborInfo {
+	case int8Follows:
+		minimal = aux >= 24
+	case int16Follows:
+		minimal = aux > math.MaxUint8
+	case int32Follows:
+		minimal = aux > math.MaxUint16
+	case int64Follows:
+		minimal = aux > math.MaxUint32
+	default:
+		return nil
+	}
+	if !minimal {
+		return dec.syntaxError("value %d of major type %d not in its shortest form", aux, cborType>>5)
+	}
+	return nil
+}
+
+func (dec *Decoder) handleInfoBits(cborInfo byte) (uint64, error) {
+	var aux uint64
+
+	if cborInfo <= 23 {
+		aux = uint64(cborInfo)
+		return aux, nil
+	} else if cborInfo == int8Follows {
+		b, err := dec.readByte()
+		return uint64(b), err
+	} else if cborInfo == int16Follows {
+		didread, err := io.ReadFull(dec.reader, dec.b8[:2])
+		if didread == 2 {
+			aux = (uint64(dec.b8[0]) << 8) | uint64(dec.b8[1])
+		}
+		return aux, err
+	} else if cborInfo == int32Follows {
+		didread, err := io.ReadFull(dec.reader, dec.b8[:4])
+		if didread == 4 {
+			aux = (uint64(dec.b8[0]) << 24) |
+				(uint64(dec.b8[1]) << 16) |
+				(uint64(dec.b8[2]) << 8) |
+				uint64(dec.b8[3])
+		}
+		return aux, err
+	} else if cborInfo == int64Follows {
+		didread, err := io.ReadFull(dec.reader, dec.b8)
+		if didread == 8 {
+			var shift uint = 56
+			i := 0
+			aux = uint64(dec.b8[i]) << shift
+			for i < 7 {
+				i += 1
+				shift -= 8
+				aux |= uint64(dec.b8[i]) << shift
+			}
+		}
+		return aux, err
+	} else if cborInfo != varFollows {
+		return 0, dec.syntaxError("reserved additional info %d", cborInfo)
+	}
+	return 0, nil
+}
+
+func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
+	cborType := c & typeMask
+	cborInfo := c & infoBits
+
+	// every target, however deeply nested, is checked before anything is
+	// read into it
+	if err := rv.Prepare(); err != nil {
+		return err
+	}
+
+	if r, ok := rv.(*reflectValue); ok {
+		if uv := r.unmarshallValue(c); uv != nil {
+			var generic interface{}
+			err := dec.innerDecodeC(r.child(reflect.ValueOf(&generic)), c)
+			if err != nil {
+				return err
+			}
+			return uv.FromCBOR(generic)
+		}
+		if rm := r.rawTarget(rawMessageType); rm.IsValid() {
+			raw, err := dec.captureItem(c)
+			if err != nil {
+				return err
+			}
+			rm.Elem().SetBytes(raw)
+			return nil
+		}
+		if jm := r.rawTarget(jsonRawMessageType); jm.IsValid() {
+			j, err := dec.decodeJSON(c)
+			if err != nil {
+				return err
+			}
+			jm.Elem().SetBytes(j)
+			return nil
+		}
+	}
+
+	aux, err := dec.handleInfoBits(cborInfo)
+	if err != nil {
+		log.Printf("error in handleInfoBits: %v", err)
+		return err
+	}
+	//log.Printf("cborType %x cborInfo %d aux %x", cborType, cborInfo, aux)
+
+	if dec.Strict && cborInfo == varFollows && cborType != cbor7 {
+		return fmt.Errorf("indefinite-length item of type %x not allowed in strict mode", cborType)
+	}
+	err = dec.checkMinimal(cborType, cborInfo, aux)
+	if err != nil {
+		return err
+	}
+
+	if cborType == cborUint {
+		return rv.SetUint(aux)
+	} else if cborType == cborNegint {
+		if aux > 0x7fffffffffffffff {
+			//return errors.New(fmt.Sprintf("cannot represent -%d", aux))
+			bigU := &big.Int{}
 			bigU.SetUint64(aux)
 			minusOne := big.NewInt(-1)
 			bn := &big.Int{}
@@ -313,14 +1172,13 @@ func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
 		if cborInfo == varFollows {
 			parts := make([][]byte, 0, 1)
 			allsize := 0
-			subc := []byte{0}
+			var subc byte
 			for true {
-				_, err = io.ReadFull(dec.reader, subc)
+				subc, err = dec.readByte()
 				if err != nil {
-					log.Printf("error reading next byte for bar bytes")
 					return err
 				}
-				if subc[0] == 0xff {
+				if subc == 0xff {
 					// done
 					var out []byte = nil
 					if len(parts) == 0 {
@@ -335,12 +1193,12 @@ func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
 					return rv.SetBytes(out)
 				} else {
 					var subb []byte = nil
-					if (subc[0] & typeMask) != cborBytes {
-						return fmt.Errorf("sub of var bytes is type %x, wanted %x", subc[0], cborBytes)
+					err = dec.checkChunk(subc, cborBytes)
+					if err != nil {
+						return err
 					}
-					err = dec.innerDecodeC(newReflectValue(reflect.ValueOf(&subb)), subc[0])
+					err = dec.innerDecodeC(newReflectValue(reflect.ValueOf(&subb)), subc)
 					if err != nil {
-						log.Printf("error decoding sub bytes")
 						return err
 					}
 					allsize += len(subb)
@@ -362,19 +1220,26 @@ func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
 		return dec.decodeMap(rv, cborInfo, aux)
 	} else if cborType == cborTag {
 		/*var innerOb interface{}*/
-		ic := []byte{0}
-		_, err = io.ReadFull(dec.reader, ic)
+		var ic byte
+		ic, err = dec.readByte()
+		if err != nil {
+			return err
+		}
+		if dec.OnTag != nil {
+			dec.OnTag(aux)
+		}
+		err = dec.checkTagContent(aux, ic)
 		if err != nil {
 			return err
 		}
 		if aux == tagBignum {
-			bn, err := dec.decodeBignum(ic[0])
+			bn, err := dec.decodeBignum(aux, ic)
 			if err != nil {
 				return err
 			}
 			return rv.SetBignum(bn)
 		} else if aux == tagNegBignum {
-			bn, err := dec.decodeBignum(ic[0])
+			bn, err := dec.decodeBignum(aux, ic)
 			if err != nil {
 				return err
 			}
@@ -382,12 +1247,30 @@ func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
 			bnOut := &big.Int{}
 			bnOut.Sub(minusOne, bn)
 			return rv.SetBignum(bnOut)
-		} else if aux == tagDecimal {
-			log.Printf("TODO: directly read bytes into decimal")
-		} else if aux == tagBigfloat {
-			log.Printf("TODO: directly read bytes into bigfloat")
 		} else {
 			decoder := dec.TagDecoders[aux]
+			if decoder == nil && aux == tagSet && dec.DecodeSets {
+				if r, ok := rv.(*reflectValue); ok {
+					setrv := *r
+					setrv.set = true
+					rv = &setrv
+				}
+				return dec.innerDecodeC(rv, ic)
+			}
+			if decoder == nil && (dec.UnwrapUnknownTags || dec.TransparentTags[aux]) {
+				return dec.innerDecodeC(rv, ic)
+			}
+			if rd, ok := decoder.(RawTagDecoder); ok {
+				raw, err := dec.captureItem(ic)
+				if err != nil {
+					return err
+				}
+				out, err := rd.DecodeRaw(raw)
+				if err != nil {
+					return err
+				}
+				return rv.SetTag(aux, nil, nil, out)
+			}
 			var target interface{}
 			var trv DecodeValue
 			var err error
@@ -397,19 +1280,20 @@ func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
 				return err
 			}
 
-			err = dec.innerDecodeC(trv, ic[0])
+			err = dec.innerDecodeC(trv, ic)
 			if err != nil {
 				return err
 			}
 
 			return rv.SetTag(aux, trv, decoder, target)
 		}
-		return nil
 	} else if cborType == cbor7 {
 		if cborInfo == int16Follows {
 			exp := (aux >> 10) & 0x01f
 			mant := aux & 0x03ff
 			var val float64
+			// every half float, subnormals included, is exact as a
+			// float64 (and float32), so this loses nothing
 			if exp == 0 {
 				val = math.Ldexp(float64(mant), -24)
 			} else if exp != 31 {
@@ -433,9 +1317,14 @@ func (dec *Decoder) innerDecodeC(rv DecodeValue, c byte) error {
 			return rv.SetBool(false)
 		} else if cborInfo == cborTrue {
 			return rv.SetBool(true)
-		} else if cborInfo == cborNull {
+		} else if cborInfo == cborNull || cborInfo == SimpleValueUndefined {
+			// Go has no separate undefined, treat it as null
 			return rv.SetNil()
 		}
+		if cborInfo == int8Follows {
+			return fmt.Errorf("%w: simple value %d", ErrUnsupportedType, aux)
+		}
+		return fmt.Errorf("%w: simple value %d", ErrUnsupportedType, cborInfo)
 	}
 
 	return err
@@ -445,70 +1334,191 @@ func (dec *Decoder) decodeText(rv DecodeValue, cborInfo byte, aux uint64) error
 	var err error
 	if cborInfo == varFollows {
 		parts := make([]string, 0, 1)
-		subc := []byte{0}
+		var subc byte
 		for true {
-			_, err = io.ReadFull(dec.reader, subc)
+			subc, err = dec.readByte()
 			if err != nil {
-				log.Printf("error reading next byte for var text")
 				return err
 			}
-			if subc[0] == 0xff {
+			if subc == 0xff {
 				// done
 				joined := strings.Join(parts, "")
 				return rv.SetString(joined)
 			} else {
-				var subtext interface{}
-				err = dec.innerDecodeC(newReflectValue(reflect.ValueOf(&subtext)), subc[0])
+				var subtext string
+				err = dec.checkChunk(subc, cborText)
 				if err != nil {
-					log.Printf("error decoding subtext")
 					return err
 				}
-				st, ok := subtext.(string)
-				if ok {
-					parts = append(parts, st)
-				} else {
-					return fmt.Errorf("var text sub element not text but %T", subtext)
+				err = dec.innerDecodeC(newReflectValue(reflect.ValueOf(&subtext)), subc)
+				if err != nil {
+					return err
 				}
+				parts = append(parts, subtext)
 			}
 		}
 	} else {
-		raw, err := dec.readBytes(aux)
+		xs, err := dec.readText(aux)
 		if err != nil {
 			return err
 		}
-		xs := string(raw)
 		return rv.SetString(xs)
 	}
 	return errors.New("internal error in decodeText, shouldn't get here")
 }
 
-func (dec *Decoder) readBytes(n uint64) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	r, err := buf.ReadFrom(&io.LimitedReader{R: dec.reader, N: int64(n)})
+// checkChunk enforces that each chunk of an indefinite-length string is a
+// definite-length string of the same major type.
+func (dec *Decoder) checkChunk(c byte, cborType byte) error {
+	if c&typeMask != cborType {
+		return dec.syntaxError("chunk of indefinite-length string has major type %d, wanted %d", c>>5, cborType>>5)
+	}
+	if c&infoBits == varFollows {
+		return dec.syntaxError("indefinite-length string nested in an indefinite-length string")
+	}
+	return nil
+}
+
+// Read a definite-length text string of n bytes. Small ones are read
+// through a reused buffer, so the string conversion is the only
+// allocation.
+func (dec *Decoder) readText(n uint64) (string, error) {
+	if n > smallBytes {
+		raw, err := dec.readBytes(n)
+		return string(raw), err
+	}
+	if _, err := dec.checkLen(n); err != nil {
+		return "", err
+	}
+	if uint64(cap(dec.textBuf)) < n {
+		size := n
+		if size < 64 {
+			size = 64
+		}
+		dec.textBuf = make([]byte, n, size)
+	}
+	buf := dec.textBuf[:n]
+	_, err := io.ReadFull(dec.reader, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return string(buf), nil
+}
 
-	if r != int64(n) {
-		return nil, io.ErrUnexpectedEOF
+func (dec *Decoder) readBytes(n uint64) ([]byte, error) {
+	if _, err := dec.checkLen(n); err != nil {
+		return nil, err
 	}
-	return buf.Bytes(), nil
+	if n <= smallBytes {
+		// small enough to allocate up front whatever the input holds
+		buf := make([]byte, n)
+		_, err := io.ReadFull(dec.reader, buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	// grow the buffer a batch at a time as the bytes arrive, so a length
+	// prefix beyond the end of the input can't force a huge allocation
+	// before the short read shows up
+	buf := make([]byte, 0, min(n, byteBatch))
+	for uint64(len(buf)) < n {
+		step := int(min(n-uint64(len(buf)), byteBatch))
+		start := len(buf)
+		buf = append(buf, make([]byte, step)...)
+		_, err := io.ReadFull(dec.reader, buf[start:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
 }
 
 type mapAssignable interface {
-	ReflectValueForKey(key interface{}) (*reflect.Value, bool)
+	// Return the value to decode into for key, or nil to skip the value.
+	ReflectValueForKey(key interface{}) (*reflect.Value, error)
 	SetReflectValueForKey(key interface{}, value reflect.Value) error
 }
 
+// Appends to an OrderedMap in encounter order.
+type orderedMapAssigner struct {
+	rv reflect.Value
+}
+
+func (om *orderedMapAssigner) ReflectValueForKey(key interface{}) (*reflect.Value, error) {
+	rv := reflect.New(interfaceType)
+	return &rv, nil
+}
+
+func (om *orderedMapAssigner) SetReflectValueForKey(key interface{}, value reflect.Value) error {
+	item := MapItem{
+		Key:   *(key.(*interface{})),
+		Value: value.Elem().Interface(),
+	}
+	om.rv.Set(reflect.Append(om.rv, reflect.ValueOf(item)))
+	return nil
+}
+
+// Array decoded into a map: alternating keys and values for a struct
+// field with the ",pairs" option, or just keys for a set.
+type arrayToMap struct {
+	ma     mapReflectValue
+	parent *reflectValue
+	set    bool
+
+	// elements decoded so far, and the pending key and value
+	n   int
+	key reflect.Value
+	val reflect.Value
+}
+
+func (r *arrayToMap) GetArrayValue(index uint64) (DecodeValue, error) {
+	if r.set || r.n%2 == 0 {
+		r.key = reflect.New(r.ma.Type().Key())
+		child := r.parent.child(r.key)
+		child.mapKey = true
+		return child, nil
+	}
+	r.val = reflect.New(r.ma.Type().Elem())
+	return r.parent.child(r.val), nil
+}
+
+func (r *arrayToMap) AppendArray(value DecodeValue) error {
+	r.n++
+	if r.set {
+		return r.ma.SetReflectValueForKey(r.key.Interface(), reflect.New(r.ma.Type().Elem()))
+	}
+	if r.n%2 != 0 {
+		return nil
+	}
+	return r.ma.SetReflectValueForKey(r.key.Interface(), r.val)
+}
+
+func (r *arrayToMap) EndArray() error {
+	if !r.set && r.n%2 != 0 {
+		return fmt.Errorf("key without value in pairs for %s", r.ma.Type().String())
+	}
+	return nil
+}
+
 type mapReflectValue struct {
 	reflect.Value
 }
 
-func (irv *mapReflectValue) ReflectValueForKey(key interface{}) (*reflect.Value, bool) {
+func (irv *mapReflectValue) ReflectValueForKey(key interface{}) (*reflect.Value, error) {
 	//var x interface{}
 	//rv := reflect.ValueOf(&x)
 	rv := reflect.New(irv.Type().Elem())
-	return &rv, true
+	return &rv, nil
 }
 func (irv *mapReflectValue) SetReflectValueForKey(key interface{}, value reflect.Value) error {
 	//log.Printf("k T %T v%#v, v T %s v %#v", key, key, value.Type().String(), value.Interface())
@@ -520,14 +1530,21 @@ func (irv *mapReflectValue) SetReflectValueForKey(key interface{}, value reflect
 		krv = krv.Elem()
 		//log.Printf("ke T %s v %#v", krv.Type().String(), krv.Interface())
 	}
-	if (krv.Kind() == reflect.Slice) || (krv.Kind() == reflect.Array) {
-		//log.Printf("key is slice or array")
+	if krv.Kind() == reflect.Slice {
+		// []byte can't be a map key, but an array such as [2]byte can
 		if krv.Type().Elem().Kind() == reflect.Uint8 {
 			//log.Printf("key is []uint8")
 			ks := string(krv.Bytes())
 			krv = reflect.ValueOf(ks)
 		}
 	}
+	if !krv.IsValid() {
+		// null key
+		krv = reflect.Zero(irv.Type().Key())
+	}
+	if !krv.Type().Comparable() {
+		return fmt.Errorf("cannot use %s as a map key", krv.Type().String())
+	}
 	irv.SetMapIndex(krv, vrv)
 
 	return nil
@@ -536,10 +1553,31 @@ func (irv *mapReflectValue) SetReflectValueForKey(key interface{}, value reflect
 type structAssigner struct {
 	Srv reflect.Value
 
+	// the field ReflectValueForKey last matched has the ",string" option
+	quoted bool
+
+	// the field ReflectValueForKey last matched has the ",pairs" option
+	pairs bool
+
+	// error on keys which match no field
+	disallowUnknown bool
+
+	// match keys to field names exactly rather than ignoring case
+	caseSensitive bool
+
+	// the ",extra" map and key for the value ReflectValueForKey last
+	// returned, if the key matched no field
+	extraMap reflect.Value
+	extraKey reflect.Value
+
+	// fields matched by a key so far, by position in structInfo.fields,
+	// kept only if some field has a default
+	seen []bool
+
 	//keyType reflect.Type
 }
 
-func (sa *structAssigner) ReflectValueForKey(key interface{}) (*reflect.Value, bool) {
+func (sa *structAssigner) ReflectValueForKey(key interface{}) (*reflect.Value, error) {
 	var skey string
 	switch tkey := key.(type) {
 	case string:
@@ -547,30 +1585,118 @@ func (sa *structAssigner) ReflectValueForKey(key interface{}) (*reflect.Value, b
 	case *string:
 		skey = *tkey
 	default:
+		if sa.disallowUnknown {
+			return nil, fmt.Errorf("unknown field key %#v of type %T in %s", key, key, sa.Srv.Type().String())
+		}
 		log.Printf("rvfk key is not string, got %T", key)
-		return nil, false
+		return nil, nil
 	}
 
-	ft := sa.Srv.Type()
-	numFields := ft.NumField()
-	for i := 0; i < numFields; i++ {
-		sf := ft.Field(i)
-		fieldname, ok := fieldname(sf)
-		if !ok {
-			continue
+	si := getStructInfo(sa.Srv.Type())
+	fields := si.fields
+	var match *fieldInfo
+	var matchPos int
+	for i := range fields {
+		if fields[i].name == skey {
+			match, matchPos = &fields[i], i
+			break
 		}
-		if (fieldname == skey) || strings.EqualFold(fieldname, skey) {
-			fieldVal := sa.Srv.FieldByName(sf.Name)
-			if !fieldVal.CanSet() {
-				log.Printf("cannot set field %s for key %s", sf.Name, skey)
-				return nil, false
+	}
+	if match == nil && !sa.caseSensitive {
+		// an exact match wins over one differing only in case
+		for i := range fields {
+			if strings.EqualFold(fields[i].name, skey) {
+				match, matchPos = &fields[i], i
+				break
 			}
-			return &fieldVal, true
 		}
 	}
-	return nil, false
+	if match != nil {
+		if si.defaults {
+			if sa.seen == nil {
+				sa.seen = make([]bool, len(fields))
+			}
+			sa.seen[matchPos] = true
+		}
+		fieldVal, err := fieldByIndexAlloc(sa.Srv, match.index)
+		if err != nil {
+			return nil, err
+		}
+		if !fieldVal.CanSet() {
+			return nil, fmt.Errorf("cannot set field %s of %s for key %s", match.name, sa.Srv.Type().String(), skey)
+		}
+		sa.quoted = match.quoted
+		sa.pairs = match.pairs
+		return &fieldVal, nil
+	}
+	if si.extra != nil {
+		return sa.extraValue(si.extra, skey)
+	}
+	if sa.disallowUnknown {
+		return nil, fmt.Errorf("unknown field %q in %s", skey, sa.Srv.Type().String())
+	}
+	return nil, nil
+}
+
+// Return a slot for the value of an unknown key, stored into the ",extra"
+// map by SetReflectValueForKey.
+func (sa *structAssigner) extraValue(index []int, skey string) (*reflect.Value, error) {
+	mv, err := fieldByIndexAlloc(sa.Srv, index)
+	if err != nil {
+		return nil, err
+	}
+	if !mv.CanSet() {
+		return nil, fmt.Errorf("cannot set extra field of %s for key %s", sa.Srv.Type().String(), skey)
+	}
+	if mv.IsNil() {
+		mv.Set(reflect.MakeMap(mv.Type()))
+	}
+	sa.quoted = false
+	sa.pairs = false
+	sa.extraMap = mv
+	sa.extraKey = reflect.ValueOf(skey).Convert(mv.Type().Key())
+	val := reflect.New(mv.Type().Elem()).Elem()
+	return &val, nil
+}
+
+// Set the fields with a default whose key the map lacked.
+func (sa *structAssigner) applyDefaults() error {
+	si := getStructInfo(sa.Srv.Type())
+	if !si.defaults {
+		return nil
+	}
+	for i := range si.fields {
+		f := &si.fields[i]
+		if !f.hasDefault || (sa.seen != nil && sa.seen[i]) {
+			continue
+		}
+		fv, err := fieldByIndexAlloc(sa.Srv, f.index)
+		if err != nil {
+			return err
+		}
+		def, err := parseDefault(fv.Type(), f.defText)
+		if err != nil {
+			return fmt.Errorf("field %s of %s: %w", f.name, sa.Srv.Type().String(), err)
+		}
+		if !fv.CanSet() {
+			return fmt.Errorf("cannot set field %s of %s to its default", f.name, sa.Srv.Type().String())
+		}
+		for fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		fv.Set(def)
+	}
+	return nil
 }
+
 func (sa *structAssigner) SetReflectValueForKey(key interface{}, value reflect.Value) error {
+	if sa.extraMap.IsValid() {
+		sa.extraMap.SetMapIndex(sa.extraKey, value)
+		sa.extraMap = reflect.Value{}
+	}
 	return nil
 }
 
@@ -578,14 +1704,17 @@ func (dec *Decoder) setMapKV(dvm DecodeValueMap, krv DecodeValue) error {
 	var err error
 	val, err := dvm.CreateMapValue(krv)
 	if err != nil {
-		var throwaway interface{}
-		err = dec.Decode(&throwaway)
+		return err
+	}
+	if val == nil {
+		// no place for this value, e.g. unknown struct field
+		c, err := dec.readByte()
 		if err != nil {
 			return err
 		}
-		return nil
+		return dec.skipItem(c)
 	}
-	err = dec.DecodeAny(val)
+	err = dec.decodeItem(val)
 	if err != nil {
 		log.Printf("error decoding map val: T %T v %#v", val, val)
 		return err
@@ -601,11 +1730,14 @@ func (dec *Decoder) setMapKV(dvm DecodeValueMap, krv DecodeValue) error {
 
 func (r *reflectValue) CreateMap() (DecodeValueMap, error) {
 	rv := r.v
-	var drv reflect.Value
-	if rv.Kind() == reflect.Ptr {
-		drv = reflect.Indirect(rv)
-	} else {
-		drv = rv
+	drv := rv
+	// allocate through nil pointers, e.g. a *Inner struct field
+	for drv.Kind() == reflect.Ptr {
+		var err error
+		drv, err = derefPtr(drv, "map")
+		if err != nil {
+			return nil, err
+		}
 	}
 	//log.Print("decode map into d ", drv.Type().String())
 
@@ -618,14 +1750,27 @@ func (r *reflectValue) CreateMap() (DecodeValueMap, error) {
 	switch drv.Kind() {
 	case reflect.Interface:
 		//log.Print("decode map into interface ", drv.Type().String())
+		if r.dec != nil && r.dec.orderedMaps && orderedMapType.AssignableTo(drv.Type()) {
+			irv = reflect.New(orderedMapType).Elem()
+			keyType = interfaceType
+			ma = &orderedMapAssigner{irv}
+			break
+		}
 		// TODO: maybe I should make this map[string]interface{}
 		nob := make(map[interface{}]interface{})
 		irv = reflect.ValueOf(nob)
+		if !irv.Type().AssignableTo(drv.Type()) {
+			return nil, fmt.Errorf("can't read map into interface type %s", drv.Type().String())
+		}
 		ma = &mapReflectValue{irv}
 		keyType = irv.Type().Key()
 	case reflect.Struct:
 		//log.Print("decode map into struct ", drv.Type().String())
-		ma = &structAssigner{drv}
+		ma = &structAssigner{
+			Srv:             drv,
+			disallowUnknown: r.dec != nil && r.dec.DisallowUnknownFields,
+			caseSensitive:   r.dec != nil && r.dec.CaseSensitiveFields,
+		}
 		keyType = reflect.TypeOf("")
 	case reflect.Map:
 		//log.Print("decode map into map ", drv.Type().String())
@@ -635,14 +1780,42 @@ func (r *reflectValue) CreateMap() (DecodeValueMap, error) {
 			} else {
 				return nil, fmt.Errorf("target map is nil and not settable")
 			}
+		} else {
+			// replace rather than merge into what was there
+			clearMap(drv)
 		}
 		keyType = drv.Type().Key()
 		ma = &mapReflectValue{drv}
+	case reflect.Slice:
+		if drv.Type() != orderedMapType {
+			return nil, fmt.Errorf("can't read map into %s", rv.Type().String())
+		}
+		drv.SetLen(0)
+		keyType = interfaceType
+		ma = &orderedMapAssigner{drv}
 	default:
 		return nil, fmt.Errorf("can't read map into %s", rv.Type().String())
 	}
 
-	return &reflectValueMap{drv, irv, ma, keyType}, nil
+	return &reflectValueMap{
+		drv:     drv,
+		irv:     irv,
+		ma:      ma,
+		keyType: keyType,
+		parent:  r,
+	}, nil
+}
+
+// Empty map rv before decoding into it. A settable map is replaced by a
+// new one, as a NaN key can't be deleted; otherwise the keys are deleted.
+func clearMap(rv reflect.Value) {
+	if rv.CanSet() {
+		rv.Set(reflect.MakeMap(rv.Type()))
+		return
+	}
+	for _, k := range rv.MapKeys() {
+		rv.SetMapIndex(k, reflect.Value{})
+	}
 }
 
 type reflectValueMap struct {
@@ -650,26 +1823,67 @@ type reflectValueMap struct {
 	irv     reflect.Value
 	ma      mapAssignable
 	keyType reflect.Type
+	parent  *reflectValue
+
+	// value slot from the last CreateMapValue
+	val reflect.Value
+
+	// Slots reused for every entry rather than allocated per entry: the
+	// key, and the value of a Go map, which SetMapIndex copies out of
+	// it. Each is zeroed before reuse so nothing of the previous entry,
+	// such as a slice's backing array, is shared with the next.
+	keySlot reflect.Value
+	valSlot reflect.Value
+	key     reflectValue
+	value   reflectValue
 }
 
 func (r *reflectValueMap) CreateMapKey() (DecodeValue, error) {
-	return newReflectValue(reflect.New(r.keyType)), nil
+	if r.keySlot.IsValid() {
+		r.keySlot.Elem().Set(reflect.Zero(r.keyType))
+	} else {
+		r.keySlot = reflect.New(r.keyType)
+	}
+	r.key = reflectValue{v: r.keySlot, dec: r.parent.dec, mapKey: true}
+	return &r.key, nil
 }
 
 func (r *reflectValueMap) CreateMapValue(key DecodeValue) (DecodeValue, error) {
-	var err error
-	v, ok := r.ma.ReflectValueForKey(key.(*reflectValue).v.Interface())
-	if !ok {
-		err = fmt.Errorf("Could not reflect value for key")
+	var v *reflect.Value
+	if mrv, ok := r.ma.(*mapReflectValue); ok {
+		if r.valSlot.IsValid() {
+			r.valSlot.Elem().Set(reflect.Zero(r.valSlot.Type().Elem()))
+		} else {
+			r.valSlot = reflect.New(mrv.Type().Elem())
+		}
+		v = &r.valSlot
+	} else {
+		var err error
+		v, err = r.ma.ReflectValueForKey(key.(*reflectValue).v.Interface())
+		if err != nil || v == nil {
+			return nil, err
+		}
 	}
-	return newReflectValue(*v), err
+	r.val = *v
+	r.value = reflectValue{v: *v, dec: r.parent.dec}
+	if sa, ok := r.ma.(*structAssigner); ok {
+		r.value.quoted = sa.quoted
+		r.value.pairs = sa.pairs
+	}
+	return &r.value, nil
 }
 
 func (r *reflectValueMap) SetMap(key, val DecodeValue) error {
-	return r.ma.SetReflectValueForKey(key.(*reflectValue).v.Interface(), val.(*reflectValue).v)
+	// r.val rather than val's value, which Prepare may have redirected
+	return r.ma.SetReflectValueForKey(key.(*reflectValue).v.Interface(), r.val)
 }
 
 func (r *reflectValueMap) EndMap() error {
+	if sa, ok := r.ma.(*structAssigner); ok {
+		if err := sa.applyDefaults(); err != nil {
+			return err
+		}
+	}
 	if r.drv.Kind() == reflect.Interface {
 		r.drv.Set(r.irv)
 	}
@@ -688,24 +1902,28 @@ func (dec *Decoder) decodeMap(rv DecodeValue, cborInfo byte, aux uint64) error {
 	}
 
 	if cborInfo == varFollows {
-		subc := []byte{0}
+		var subc byte
 		for true {
-			_, err = io.ReadFull(dec.reader, subc)
+			subc, err = dec.readByte()
 			if err != nil {
 				log.Printf("error reading next byte for var text")
 				return err
 			}
-			if subc[0] == 0xff {
+			if subc == 0xff {
 				// Done
 				break
 			} else {
+				err = dec.countElements(1)
+				if err != nil {
+					return err
+				}
 				//var key interface{}
 				krv, err := dvm.CreateMapKey()
 				if err != nil {
 					return err
 				}
 				//var val interface{}
-				err = dec.innerDecodeC(krv, subc[0])
+				err = dec.innerDecodeC(krv, subc)
 				if err != nil {
 					log.Printf("error decoding map key V, %s", err)
 					return err
@@ -718,6 +1936,14 @@ func (dec *Decoder) decodeMap(rv DecodeValue, cborInfo byte, aux uint64) error {
 			}
 		}
 	} else {
+		_, err = dec.checkLen(aux)
+		if err != nil {
+			return err
+		}
+		err = dec.countElements(aux)
+		if err != nil {
+			return err
+		}
 		var i uint64
 		for i = 0; i < aux; i++ {
 			//var key interface{}
@@ -727,7 +1953,7 @@ func (dec *Decoder) decodeMap(rv DecodeValue, cborInfo byte, aux uint64) error {
 			}
 			//var val interface{}
 			//err = dec.Decode(&key)
-			err = dec.DecodeAny(krv)
+			err = dec.decodeItem(krv)
 			if err != nil {
 				log.Printf("error decoding map key #, %s", err)
 				return err
@@ -745,13 +1971,18 @@ func (dec *Decoder) decodeMap(rv DecodeValue, cborInfo byte, aux uint64) error {
 func (r *reflectValue) CreateArray(makeLength int) (DecodeValueArray, error) {
 	var rv reflect.Value = r.v
 
-	if rv.Kind() == reflect.Ptr {
-		rv = reflect.Indirect(rv)
+	for rv.Kind() == reflect.Ptr {
+		var err error
+		rv, err = derefPtr(rv, "array")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// inner reflect value
 	var irv reflect.Value
 	var elemType reflect.Type
+	var fields []fieldInfo
 
 	switch rv.Kind() {
 	case reflect.Interface:
@@ -759,17 +1990,61 @@ func (r *reflectValue) CreateArray(makeLength int) (DecodeValueArray, error) {
 		nob := make([]interface{}, 0, makeLength)
 		irv = reflect.ValueOf(nob)
 		elemType = irv.Type().Elem()
+		if !irv.Type().AssignableTo(rv.Type()) {
+			return nil, fmt.Errorf("can't read array into interface type %s", rv.Type().String())
+		}
 	case reflect.Slice:
-		// we have a slice
+		// we have a slice, make room for the declared elements up front
+		// so they can be decoded in place. Like encoding/json, existing
+		// contents are replaced but the capacity is reused.
 		irv = rv
+		if !irv.IsNil() {
+			irv = irv.Slice(0, 0)
+		}
 		elemType = irv.Type().Elem()
+		if irv.Cap()-irv.Len() < makeLength {
+			grown := reflect.MakeSlice(irv.Type(), irv.Len(), irv.Len()+makeLength)
+			reflect.Copy(grown, irv)
+			irv = grown
+		}
 	case reflect.Array:
 		// no irv, no elemType
+	case reflect.Complex64, reflect.Complex128:
+		// [real, imag], collected as floats of the matching width
+		elemType = reflect.TypeOf(float64(0))
+		if rv.Kind() == reflect.Complex64 {
+			elemType = reflect.TypeOf(float32(0))
+		}
+		irv = reflect.New(reflect.ArrayOf(2, elemType)).Elem()
+	case reflect.Struct:
+		si := getStructInfo(rv.Type())
+		if !si.toArray {
+			return nil, fmt.Errorf("can't read array into struct %s without toarray", rv.Type().String())
+		}
+		fields = si.fields
+	case reflect.Map:
+		set := r.set && rv.Type().Elem() == emptyStructType
+		if !r.pairs && !set {
+			return nil, fmt.Errorf("can't read array into map %s without pairs", rv.Type().String())
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		} else {
+			clearMap(rv)
+		}
+		return &arrayToMap{ma: mapReflectValue{rv}, parent: r, set: set}, nil
 	default:
 		return nil, fmt.Errorf("can't read array into %s", rv.Type().String())
 	}
 
-	return &reflectValueArray{rv, makeLength, irv, elemType, 0}, nil
+	return &reflectValueArray{
+		rv:         rv,
+		makeLength: makeLength,
+		irv:        irv,
+		elemType:   elemType,
+		fields:     fields,
+		parent:     r,
+	}, nil
 }
 
 type reflectValueArray struct {
@@ -778,27 +2053,76 @@ type reflectValueArray struct {
 	irv        reflect.Value
 	elemType   reflect.Type
 	arrayPos   int
+
+	// fields of a toarray struct, in array order
+	fields []fieldInfo
+
+	parent *reflectValue
+
+	// slice element from the last GetArrayValue
+	elem reflect.Value
 }
 
 func (r *reflectValueArray) GetArrayValue(index uint64) (DecodeValue, error) {
-	if r.rv.Kind() == reflect.Array {
-		return &reflectValue{r.rv.Index(r.arrayPos)}, nil
-	} else {
-		return &reflectValue{reflect.New(r.elemType)}, nil
+	switch r.rv.Kind() {
+	case reflect.Array:
+		if r.arrayPos >= r.rv.Len() {
+			return nil, fmt.Errorf("too many array elements for %s", r.rv.Type().String())
+		}
+		return r.parent.child(r.rv.Index(r.arrayPos)), nil
+	case reflect.Complex64, reflect.Complex128:
+		if r.arrayPos >= 2 {
+			return nil, fmt.Errorf("too many array elements for %s", r.rv.Type().String())
+		}
+		return r.parent.child(r.irv.Index(r.arrayPos)), nil
+	case reflect.Struct:
+		if r.arrayPos >= len(r.fields) {
+			return nil, fmt.Errorf("too many array elements for struct %s", r.rv.Type().String())
+		}
+		field := r.fields[r.arrayPos]
+		fv, err := fieldByIndexAlloc(r.rv, field.index)
+		if err != nil {
+			return nil, err
+		}
+		child := r.parent.child(fv)
+		child.quoted = field.quoted
+		child.pairs = field.pairs
+		return child, nil
+	default:
+		// extend the slice by one element and decode straight into it
+		n := r.irv.Len()
+		if n < r.irv.Cap() {
+			r.irv = r.irv.Slice(0, n+1)
+			r.elem = r.irv.Index(n)
+			// may hold a stale value from the backing array
+			r.elem.Set(reflect.Zero(r.elemType))
+		} else {
+			r.irv = reflect.Append(r.irv, reflect.Zero(r.elemType))
+			r.elem = r.irv.Index(n)
+		}
+		return r.parent.child(r.elem), nil
 	}
 }
 
 func (r *reflectValueArray) AppendArray(subrv DecodeValue) error {
-	if r.rv.Kind() == reflect.Array {
+	switch r.rv.Kind() {
+	case reflect.Array, reflect.Struct, reflect.Complex64, reflect.Complex128:
 		r.arrayPos++
-	} else {
-		r.irv = reflect.Append(r.irv, reflect.Indirect(subrv.(*reflectValue).v))
+	default:
+		// already decoded in place by GetArrayValue
 	}
 	return nil
 }
 
 func (r *reflectValueArray) EndArray() error {
-	if r.rv.Kind() != reflect.Array {
+	switch r.rv.Kind() {
+	case reflect.Array, reflect.Struct:
+	case reflect.Complex64, reflect.Complex128:
+		if r.arrayPos != 2 {
+			return fmt.Errorf("need 2 array elements for %s, got %d", r.rv.Type().String(), r.arrayPos)
+		}
+		r.rv.SetComplex(complex(r.irv.Index(0).Float(), r.irv.Index(1).Float()))
+	default:
 		r.rv.Set(r.irv)
 	}
 	return nil
@@ -813,7 +2137,16 @@ func (dec *Decoder) decodeArray(rv DecodeValue, cborInfo byte, aux uint64) error
 	if cborInfo == varFollows {
 		// no special capacity to allocate the slice to
 	} else {
-		makeLength = int(aux)
+		// charge the declared length up front so a huge header fails
+		// before anything is allocated
+		makeLength, err = dec.checkLen(aux)
+		if err != nil {
+			return err
+		}
+		err = dec.countElements(aux)
+		if err != nil {
+			return err
+		}
 	}
 
 	dva, err = rv.CreateArray(int(min(uint64(makeLength), uint64(arrayBatch))))
@@ -823,23 +2156,27 @@ func (dec *Decoder) decodeArray(rv DecodeValue, cborInfo byte, aux uint64) error
 
 	if cborInfo == varFollows {
 		//log.Printf("var array")
-		subc := []byte{0}
+		var subc byte
 		var idx uint64 = 0
 		for true {
-			_, err = io.ReadFull(dec.reader, subc)
+			subc, err = dec.readByte()
 			if err != nil {
 				log.Printf("error reading next byte for var text")
 				return err
 			}
-			if subc[0] == 0xff {
+			if subc == 0xff {
 				// Done
 				break
 			}
+			err = dec.countElements(1)
+			if err != nil {
+				return err
+			}
 			subrv, err := dva.GetArrayValue(idx)
 			if err != nil {
 				return err
 			}
-			err = dec.innerDecodeC(subrv, subc[0])
+			err = dec.innerDecodeC(subrv, subc)
 			if err != nil {
 				log.Printf("error decoding array subob")
 				return err
@@ -857,7 +2194,7 @@ func (dec *Decoder) decodeArray(rv DecodeValue, cborInfo byte, aux uint64) error
 			if err != nil {
 				return err
 			}
-			err = dec.DecodeAny(subrv)
+			err = dec.decodeItem(subrv)
 			if err != nil {
 				log.Printf("error decoding array subob")
 				return err
@@ -872,73 +2209,120 @@ func (dec *Decoder) decodeArray(rv DecodeValue, cborInfo byte, aux uint64) error
 	return dva.EndArray()
 }
 
-func (dec *Decoder) decodeBignum(c byte) (*big.Int, error) {
+func (dec *Decoder) decodeBignum(tag uint64, c byte) (*big.Int, error) {
 	cborType := c & typeMask
 	cborInfo := c & infoBits
 
-	aux, err := dec.handleInfoBits(cborInfo)
-	if err != nil {
-		log.Printf("error in bignum handleInfoBits: %v", err)
-		return nil, err
-	}
-	//log.Printf("bignum cborType %x cborInfo %d aux %x", cborType, cborInfo, aux)
-
 	if cborType != cborBytes {
-		return nil, fmt.Errorf("attempting to decode bignum but sub object is not bytes but type %x", cborType)
-	}
-
-	rawbytes, err := dec.readBytes(aux)
-	if err != nil {
-		return nil, err
+		return nil, dec.tagContentError(tag, "bignum must hold a byte string, got major type %d", cborType>>5)
 	}
 
-	bn := big.NewInt(0)
-	littleBig := &big.Int{}
-	d := &big.Int{}
-	for _, bv := range rawbytes {
-		d.Lsh(bn, 8)
-		littleBig.SetUint64(uint64(bv))
-		bn.Or(d, littleBig)
+	var rawbytes []byte
+	if cborInfo == varFollows {
+		// chunks are each checked against MaxLen, the total is below
+		err := dec.innerDecodeC(newReflectValue(reflect.ValueOf(&rawbytes)), c)
+		if err != nil {
+			return nil, err
+		}
+		_, err = dec.checkLen(uint64(len(rawbytes)))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		aux, err := dec.handleInfoBits(cborInfo)
+		if err != nil {
+			return nil, err
+		}
+		err = dec.checkMinimal(cborType, cborInfo, aux)
+		if err != nil {
+			return nil, err
+		}
+		// readBytes refuses lengths beyond MaxLen before reading
+		rawbytes, err = dec.readBytes(aux)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return bn, nil
+	return new(big.Int).SetBytes(rawbytes), nil
 }
 
 func (r *reflectValue) SetBignum(x *big.Int) error {
 	rv := r.v
+	if r.isNumberTarget() {
+		rv.Set(reflect.ValueOf(Number(x.String())))
+		return nil
+	}
 	switch rv.Kind() {
 	case reflect.Ptr:
-		return newReflectValue(reflect.Indirect(rv)).SetBignum(x)
+		erv, err := derefPtr(rv, "bignum")
+		if err != nil {
+			return err
+		}
+		return r.child(erv).SetBignum(x)
 	case reflect.Interface:
+		return setInterface(rv, reflect.ValueOf(*x))
+	case reflect.Struct:
+		if rv.Type() != bigIntType {
+			return fmt.Errorf("cannot assign bignum into struct %s", rv.Type().String())
+		}
 		rv.Set(reflect.ValueOf(*x))
 		return nil
-	case reflect.Int32:
-		if x.BitLen() < 32 {
-			rv.SetInt(x.Int64())
-			return nil
-		} else {
-			return fmt.Errorf("int too big for int32 target")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !x.IsInt64() || rv.OverflowInt(x.Int64()) {
+			return fmt.Errorf("bignum %s does not fit into target of type %s", x.String(), rv.Type().String())
 		}
-	case reflect.Int, reflect.Int64:
-		if x.BitLen() < 64 {
-			rv.SetInt(x.Int64())
-			return nil
-		} else {
-			return fmt.Errorf("int too big for int64 target")
+		rv.SetInt(x.Int64())
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !x.IsUint64() || rv.OverflowUint(x.Uint64()) {
+			return fmt.Errorf("bignum %s does not fit into target of type %s", x.String(), rv.Type().String())
 		}
+		rv.SetUint(x.Uint64())
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, _ := new(big.Float).SetInt(x).Float64()
+		rv.SetFloat(f)
+		return nil
 	default:
-		return fmt.Errorf("cannot assign bignum into Kind=%s Type=%s %#v", rv.Kind().String(), rv.Type().String(), rv)
+		return r.typeError("bignum")
 	}
 }
 
 func (r *reflectValue) SetBytes(buf []byte) error {
 	rv := r.v
+	// IP addresses are commonly sent as their 4 or 16 raw bytes
+	switch rv.Type() {
+	case ipType:
+		if len(buf) != net.IPv4len && len(buf) != net.IPv6len {
+			return fmt.Errorf("cannot decode %d bytes into net.IP", len(buf))
+		}
+		rv.SetBytes(append([]byte(nil), buf...))
+		return nil
+	case netipAddrType:
+		addr, ok := netip.AddrFromSlice(buf)
+		if !ok {
+			return fmt.Errorf("cannot decode %d bytes into netip.Addr", len(buf))
+		}
+		rv.Set(reflect.ValueOf(addr))
+		return nil
+	}
+	// a []byte target takes the raw bytes even if it could parse text
+	isByteSlice := rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8
+	if tu := textUnmarshaler(rv); tu != nil && !isByteSlice {
+		return tu.UnmarshalText(buf)
+	}
 	switch rv.Kind() {
 	case reflect.Ptr:
-		return newReflectValue(reflect.Indirect(rv)).SetBytes(buf)
+		erv, err := derefPtr(rv, "[]byte")
+		if err != nil {
+			return err
+		}
+		child := r.child(erv)
+		child.mapKey = r.mapKey
+		return child.SetBytes(buf)
 	case reflect.Interface:
-		rv.Set(reflect.ValueOf(buf))
-		return nil
+		return setInterface(rv, reflect.ValueOf(buf))
 	case reflect.Slice:
 		if rv.Type().Elem().Kind() == reflect.Uint8 {
 			rv.SetBytes(buf)
@@ -946,27 +2330,39 @@ func (r *reflectValue) SetBytes(buf []byte) error {
 		} else {
 			return fmt.Errorf("cannot write []byte to k=%s %s", rv.Kind().String(), rv.Type().String())
 		}
+	case reflect.Array:
+		if rv.Type().Elem().Kind() != reflect.Uint8 {
+			return r.typeError("[]byte")
+		}
+		if len(buf) != rv.Len() {
+			return fmt.Errorf("cannot assign %d bytes into %s", len(buf), rv.Type().String())
+		}
+		reflect.Copy(rv, reflect.ValueOf(buf))
+		return nil
 	case reflect.String:
-		rv.Set(reflect.ValueOf(string(buf)))
+		if r.mapKey && r.dec != nil && r.dec.RejectByteStringKeys {
+			return fmt.Errorf("byte string key %x for %s key", buf, rv.Type().String())
+		}
+		rv.SetString(string(buf))
 		return nil
 	default:
-		return fmt.Errorf("cannot assign []byte into Kind=%s Type=%s %#v", rv.Kind().String(), "" /*rv.Type().String()*/, rv)
+		return r.typeError("[]byte")
 	}
 }
 
 func (r *reflectValue) SetUint(u uint64) error {
 	rv := r.v
+	if r.isNumberTarget() {
+		rv.Set(reflect.ValueOf(Number(strconv.FormatUint(u, 10))))
+		return nil
+	}
 	switch rv.Kind() {
 	case reflect.Ptr:
-		if rv.IsNil() {
-			if rv.CanSet() {
-				rv.Set(reflect.New(rv.Type().Elem()))
-				// fall through to set indirect below
-			} else {
-				return fmt.Errorf("trying to put uint into unsettable nil ptr")
-			}
+		erv, err := derefPtr(rv, "uint")
+		if err != nil {
+			return err
 		}
-		return newReflectValue(reflect.Indirect(rv)).SetUint(u)
+		return r.child(erv).SetUint(u)
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		if rv.OverflowUint(u) {
 			return fmt.Errorf("value %d does not fit into target of type %s", u, rv.Kind().String())
@@ -974,23 +2370,38 @@ func (r *reflectValue) SetUint(u uint64) error {
 		rv.SetUint(u)
 		return nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		if (u == 0xffffffffffffffff) || rv.OverflowInt(int64(u)) {
+		if u > math.MaxInt64 || rv.OverflowInt(int64(u)) {
 			return fmt.Errorf("value %d does not fit into target of type %s", u, rv.Kind().String())
 		}
 		rv.SetInt(int64(u))
 		return nil
 	case reflect.Interface:
-		rv.Set(reflect.ValueOf(u))
-		return nil
+		if r.dec != nil && r.dec.IntDecodeMode == IntDecodeInt64 && u <= math.MaxInt64 {
+			return setInterface(rv, reflect.ValueOf(int64(u)))
+		}
+		return setInterface(rv, reflect.ValueOf(u))
+	case reflect.Struct:
+		if rv.Type() != bigIntType {
+			return r.typeError("uint")
+		}
+		return r.SetBignum(new(big.Int).SetUint64(u))
 	default:
-		return fmt.Errorf("cannot assign uint into Kind=%s Type=%#v %#v", rv.Kind().String(), rv.Type(), rv)
+		return r.typeError("uint")
 	}
 }
 func (r *reflectValue) SetInt(i int64) error {
 	rv := r.v
+	if r.isNumberTarget() {
+		rv.Set(reflect.ValueOf(Number(strconv.FormatInt(i, 10))))
+		return nil
+	}
 	switch rv.Kind() {
 	case reflect.Ptr:
-		return newReflectValue(reflect.Indirect(rv)).SetInt(i)
+		erv, err := derefPtr(rv, "int")
+		if err != nil {
+			return err
+		}
+		return r.child(erv).SetInt(i)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		if rv.OverflowInt(i) {
 			return fmt.Errorf("value %d does not fit into target of type %s", i, rv.Kind().String())
@@ -998,56 +2409,112 @@ func (r *reflectValue) SetInt(i int64) error {
 		rv.SetInt(i)
 		return nil
 	case reflect.Interface:
-		rv.Set(reflect.ValueOf(i))
-		return nil
+		return setInterface(rv, reflect.ValueOf(i))
+	case reflect.Struct:
+		if rv.Type() != bigIntType {
+			return r.typeError("int")
+		}
+		return r.SetBignum(big.NewInt(i))
 	default:
-		return fmt.Errorf("cannot assign int into Kind=%s Type=%#v %#v", rv.Kind().String(), rv.Type(), rv)
+		return r.typeError("int")
 	}
 }
 func (r *reflectValue) SetFloat32(f float32) error {
 	rv := r.v
+	if r.isNumberTarget() {
+		rv.Set(reflect.ValueOf(Number(formatFloatNumber(float64(f), 32))))
+		return nil
+	}
 	switch rv.Kind() {
 	case reflect.Ptr:
-		return newReflectValue(reflect.Indirect(rv)).SetFloat32(f)
+		erv, err := derefPtr(rv, "float32")
+		if err != nil {
+			return err
+		}
+		return r.child(erv).SetFloat32(f)
 	case reflect.Float32, reflect.Float64:
 		rv.SetFloat(float64(f))
 		return nil
 	case reflect.Interface:
-		rv.Set(reflect.ValueOf(f))
-		return nil
+		if r.dec != nil && r.dec.FloatDecodeMode == FloatDecodeBigFloat {
+			return r.setBigFloat(float64(f))
+		}
+		return setInterface(rv, reflect.ValueOf(f))
+	case reflect.Struct:
+		if rv.Type() != bigFloatType {
+			return r.typeError("float32")
+		}
+		return r.setBigFloat(float64(f))
 	default:
-		return fmt.Errorf("cannot assign float32 into Kind=%s Type=%#v %#v", rv.Kind().String(), rv.Type(), rv)
+		return r.typeError("float32")
 	}
 }
 func (r *reflectValue) SetFloat64(d float64) error {
 	rv := r.v
+	if r.isNumberTarget() {
+		rv.Set(reflect.ValueOf(Number(formatFloatNumber(d, 64))))
+		return nil
+	}
 	switch rv.Kind() {
 	case reflect.Ptr:
-		return newReflectValue(reflect.Indirect(rv)).SetFloat64(d)
+		erv, err := derefPtr(rv, "float64")
+		if err != nil {
+			return err
+		}
+		return r.child(erv).SetFloat64(d)
 	case reflect.Float32, reflect.Float64:
 		rv.SetFloat(d)
 		return nil
 	case reflect.Interface:
-		rv.Set(reflect.ValueOf(d))
-		return nil
+		if r.dec != nil && r.dec.FloatDecodeMode == FloatDecodeBigFloat {
+			return r.setBigFloat(d)
+		}
+		return setInterface(rv, reflect.ValueOf(d))
+	case reflect.Struct:
+		if rv.Type() != bigFloatType {
+			return r.typeError("float64")
+		}
+		return r.setBigFloat(d)
 	default:
-		return fmt.Errorf("cannot assign float64 into Kind=%s Type=%#v %#v", rv.Kind().String(), rv.Type(), rv)
+		return r.typeError("float64")
+	}
+}
+
+// Store a float, exactly, into a big.Float target or as a *big.Float into
+// an interface{} one. big.Float has no NaN.
+func (r *reflectValue) setBigFloat(d float64) error {
+	if math.IsNaN(d) {
+		return fmt.Errorf("cannot decode NaN into a big.Float")
+	}
+	bf := new(big.Float).SetFloat64(d)
+	if r.v.Kind() == reflect.Interface {
+		return setInterface(r.v, reflect.ValueOf(bf))
 	}
+	r.v.Set(reflect.ValueOf(bf).Elem())
+	return nil
 }
+
+// Null clears pointers, interfaces, slices and maps to nil, and zeroes
+// strings, structs and arrays. Numbers and bools have no null, so null
+// into one is an UnmarshalTypeError.
 func (r *reflectValue) SetNil() error {
 	rv := r.v
 	switch rv.Kind() {
 	case reflect.Ptr:
-		//return setNil(reflect.Indirect(rv))
-		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
-	case reflect.Interface:
+		if rv.CanSet() {
+			// a pointer field or element becomes nil
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
 		if rv.IsNil() {
-			// already nil, okay!
 			return nil
 		}
-		rv.Set(reflect.Zero(rv.Type()))
+		return r.child(rv.Elem()).SetNil()
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return r.typeError("null")
 	default:
-		log.Printf("setNil wat %s", rv.Type())
 		rv.Set(reflect.Zero(rv.Type()))
 	}
 	return nil
@@ -1055,51 +2522,292 @@ func (r *reflectValue) SetNil() error {
 
 func (r *reflectValue) SetBool(b bool) error {
 	rv := r.v
-	reflect.Indirect(rv).Set(reflect.ValueOf(b))
-	return nil
+	switch rv.Kind() {
+	case reflect.Ptr:
+		erv, err := derefPtr(rv, "bool")
+		if err != nil {
+			return err
+		}
+		return r.child(erv).SetBool(b)
+	case reflect.Bool:
+		if !rv.CanSet() {
+			return fmt.Errorf("cannot assign bool into unsettable %s", rv.Type().String())
+		}
+		rv.SetBool(b)
+		return nil
+	case reflect.Interface:
+		return setInterface(rv, reflect.ValueOf(b))
+	default:
+		return r.typeError("bool")
+	}
 }
 
 func (r *reflectValue) SetString(xs string) error {
 	rv := r.v
-	// handle either concrete string or string* to nil
-	deref := reflect.Indirect(rv)
-	if !deref.CanSet() {
-		rv.Set(reflect.ValueOf(&xs))
-	} else {
-		deref.Set(reflect.ValueOf(xs))
+	// untagged timestamps are common; parse them without going through
+	// UnmarshalText
+	if rv.Type() == timeType {
+		t, err := time.Parse(time.RFC3339Nano, xs)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
 	}
-	//reflect.Indirect(rv).Set(reflect.ValueOf(joined))
-	return nil
-}
-
-func (r *reflectValue) CreateTag(aux uint64, decoder TagDecoder) (DecodeValue, interface{}, error) {
-	if decoder != nil {
-		target := decoder.DecodeTarget()
-		return newReflectValue(reflect.ValueOf(target)), target, nil
-	} else {
-		target := &CBORTag{}
-		target.Tag = aux
-		return newReflectValue(reflect.ValueOf(&target.WrappedObject)), target, nil
+	if tu := textUnmarshaler(rv); tu != nil {
+		return tu.UnmarshalText([]byte(xs))
 	}
-}
-
-func (r *reflectValue) SetTag(code uint64, val DecodeValue, decoder TagDecoder, target interface{}) error {
-	rv := r.v
-	var err error
-	if decoder != nil {
-		target, err = decoder.PostDecode(target)
+	if r.quoted {
+		if ok, err := setQuoted(rv, xs); ok {
+			return err
+		}
+	}
+	if rv.Type() == durationType {
+		d, err := time.ParseDuration(xs)
 		if err != nil {
 			return err
 		}
+		rv.SetInt(int64(d))
+		return nil
 	}
-	reflect.Indirect(rv).Set(reflect.ValueOf(target))
-	return nil
-}
-
-// copied from encoding/json/decode.go
-// An InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
-// (The argument to Unmarshal must be a non-nil pointer.)
-type InvalidUnmarshalError struct {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		erv, err := derefPtr(rv, "string")
+		if err != nil {
+			return err
+		}
+		child := r.child(erv)
+		child.quoted = r.quoted
+		return child.SetString(xs)
+	case reflect.String:
+		rv.SetString(xs)
+		return nil
+	case reflect.Slice:
+		switch rv.Type().Elem().Kind() {
+		case reflect.Int32:
+			rv.Set(reflect.ValueOf([]rune(xs)).Convert(rv.Type()))
+		case reflect.Uint8:
+			// the UTF-8 bytes, not base64 as in encoding/json
+			rv.Set(reflect.ValueOf([]byte(xs)).Convert(rv.Type()))
+		default:
+			return r.typeError("string")
+		}
+		return nil
+	case reflect.Array:
+		if rv.Type().Elem().Kind() != reflect.Uint8 {
+			return r.typeError("string")
+		}
+		if len(xs) != rv.Len() {
+			return fmt.Errorf("cannot assign %d byte string into %s", len(xs), rv.Type().String())
+		}
+		reflect.Copy(rv, reflect.ValueOf([]byte(xs)))
+		return nil
+	case reflect.Interface:
+		return setInterface(rv, reflect.ValueOf(xs))
+	default:
+		return r.typeError("string")
+	}
+}
+
+// setQuoted parses the text of a ",string" number or bool field, returning
+// false if rv isn't one.
+func setQuoted(rv reflect.Value, xs string) (bool, error) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := strconv.ParseInt(xs, 10, rv.Type().Bits())
+		if err != nil {
+			return true, fmt.Errorf("cannot parse %q into %s: %v", xs, rv.Type(), err)
+		}
+		rv.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := strconv.ParseUint(xs, 10, rv.Type().Bits())
+		if err != nil {
+			return true, fmt.Errorf("cannot parse %q into %s: %v", xs, rv.Type(), err)
+		}
+		rv.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(xs, rv.Type().Bits())
+		if err != nil {
+			return true, fmt.Errorf("cannot parse %q into %s: %v", xs, rv.Type(), err)
+		}
+		rv.SetFloat(x)
+	case reflect.Bool:
+		x, err := strconv.ParseBool(xs)
+		if err != nil {
+			return true, fmt.Errorf("cannot parse %q into %s: %v", xs, rv.Type(), err)
+		}
+		rv.SetBool(x)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Number is a CBOR integer or float kept as its exact decimal text, which
+// a Decoder with UseNumber set produces for interface{} targets. Like
+// json.Number it converts on demand without passing through a type which
+// might lose precision or the sign. Floats always contain a '.', an
+// exponent, or are NaN/Inf, so they can be told apart from integers.
+type Number string
+
+var numberType = reflect.TypeOf(Number(""))
+var bigIntType = reflect.TypeOf(big.Int{})
+var bigFloatType = reflect.TypeOf(big.Float{})
+var durationType = reflect.TypeOf(time.Duration(0))
+var timeType = reflect.TypeOf(time.Time{})
+var bigIntPtrType = reflect.TypeOf((*big.Int)(nil))
+
+func (n Number) String() string { return string(n) }
+
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
+func (n Number) Uint64() (uint64, error) {
+	return strconv.ParseUint(string(n), 10, 64)
+}
+
+func (n Number) Float64() (float64, error) {
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Format a float as Number text which survives a round trip at the given
+// bit size and doesn't look like an integer.
+func formatFloatNumber(f float64, bitSize int) string {
+	text := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if !strings.ContainsAny(text, ".eEIN") {
+		text += ".0"
+	}
+	return text
+}
+
+// Report whether a numeric item should be stored as a Number: the target
+// is a Number, or an empty interface with UseNumber set.
+func (r *reflectValue) isNumberTarget() bool {
+	rv := r.v
+	if rv.Type() == numberType {
+		return true
+	}
+	return r.dec != nil && r.dec.UseNumber && rv.Kind() == reflect.Interface && rv.NumMethod() == 0
+}
+
+// Return the target as an encoding.TextUnmarshaler if its address
+// implements that, else nil. Pointer targets are handled once the Set
+// method has dereferenced them.
+func textUnmarshaler(rv reflect.Value) encoding.TextUnmarshaler {
+	if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface || !rv.CanAddr() {
+		return nil
+	}
+	tu, _ := rv.Addr().Interface().(encoding.TextUnmarshaler)
+	return tu
+}
+
+// Return the target as an UnmarshallValue, allocating a nil pointer
+// target first, or nil if it isn't one or the item c is a null which
+// should just clear a pointer.
+func (r *reflectValue) unmarshallValue(c byte) UnmarshallValue {
+	rv := r.v
+	switch {
+	case rv.Kind() == reflect.Ptr && rv.Type().Implements(unmarshallValueType):
+		if c == cbor7|cborNull {
+			return nil
+		}
+		if rv.IsNil() {
+			if !rv.CanSet() {
+				return nil
+			}
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return rv.Interface().(UnmarshallValue)
+	case rv.Kind() != reflect.Ptr && rv.Kind() != reflect.Interface && rv.CanAddr() && rv.Addr().Type().Implements(unmarshallValueType):
+		return rv.Addr().Interface().(UnmarshallValue)
+	}
+	return nil
+}
+
+// Return a pointer to the target if it is or points to a value of type t,
+// such as RawMessage, allocating a nil pointer; otherwise an invalid
+// Value.
+func (r *reflectValue) rawTarget(t reflect.Type) reflect.Value {
+	rv := r.v
+	switch {
+	case rv.Type() == t && rv.CanAddr():
+		return rv.Addr()
+	case rv.Kind() == reflect.Ptr && rv.Type().Elem() == t:
+		if rv.IsNil() {
+			if !rv.CanSet() {
+				return reflect.Value{}
+			}
+			rv.Set(reflect.New(t))
+		}
+		return rv
+	}
+	return reflect.Value{}
+}
+
+// Dereference a pointer target, first allocating the pointed-to value if
+// the pointer is nil.
+func derefPtr(rv reflect.Value, what string) (reflect.Value, error) {
+	if rv.IsNil() {
+		if !rv.CanSet() {
+			return reflect.Value{}, fmt.Errorf("trying to put %s into unsettable nil ptr", what)
+		}
+		rv.Set(reflect.New(rv.Type().Elem()))
+	}
+	return rv.Elem(), nil
+}
+
+func (r *reflectValue) CreateTag(aux uint64, decoder TagDecoder) (DecodeValue, interface{}, error) {
+	if decoder != nil {
+		target := decoder.DecodeTarget()
+		return r.child(reflect.ValueOf(target)), target, nil
+	} else {
+		target := &CBORTag{}
+		target.Tag = aux
+		return r.child(reflect.ValueOf(&target.WrappedObject)), target, nil
+	}
+}
+
+func (r *reflectValue) SetTag(code uint64, val DecodeValue, decoder TagDecoder, target interface{}) error {
+	rv := r.v
+	var err error
+	if decoder != nil {
+		target, err = decoder.PostDecode(target)
+		if err != nil {
+			return err
+		}
+	}
+	tv := reflect.ValueOf(target)
+	if rv.Kind() == reflect.Ptr && rv.CanSet() && (!tv.IsValid() || tv.Type().AssignableTo(rv.Type())) {
+		// e.g. a *url.URL into a *url.URL field
+		if !tv.IsValid() {
+			tv = reflect.Zero(rv.Type())
+		}
+		rv.Set(tv)
+		return nil
+	}
+	drv := rv
+	if rv.Kind() == reflect.Ptr {
+		drv, err = derefPtr(rv, "tag")
+		if err != nil {
+			return err
+		}
+	}
+	if !tv.IsValid() {
+		drv.Set(reflect.Zero(drv.Type()))
+		return nil
+	}
+	if !tv.Type().AssignableTo(drv.Type()) {
+		return fmt.Errorf("cannot assign tag %d value %s into %s", code, tv.Type().String(), drv.Type().String())
+	}
+	drv.Set(tv)
+	return nil
+}
+
+// copied from encoding/json/decode.go
+// An InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+// (The argument to Unmarshal must be a non-nil pointer.)
+type InvalidUnmarshalError struct {
 	Type reflect.Type
 }
 
@@ -1128,49 +2836,725 @@ func (t *CBORTag) ToCBOR(w io.Writer, enc *Encoder) error {
 	return enc.Encode(t.WrappedObject)
 }
 
+// UUID is an RFC 4122 UUID, encoded as tag 37 around its 16 bytes. A
+// Decoder turns tag 37 into a UUID, checking the length.
+type UUID [16]byte
+
+func (u UUID) ToCBOR(w io.Writer, enc *Encoder) error {
+	_, err := w.Write(EncodeInt(MajorTypeTag, tagUUID, nil))
+	if err != nil {
+		return err
+	}
+	return enc.writeBytes(u[:])
+}
+
+// Format as 8-4-4-4-12 hex digits.
+func (u UUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// Built in TagDecoder for tag 37.
+type uuidTagDecoder struct{}
+
+func (uuidTagDecoder) GetTag() uint64 { return tagUUID }
+
+func (uuidTagDecoder) DecodeTarget() interface{} { return new([]byte) }
+
+func (uuidTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	b := *(v.(*[]byte))
+	if len(b) != 16 {
+		return nil, fmt.Errorf("UUID tag 37 must hold 16 bytes, got %d", len(b))
+	}
+	var u UUID
+	copy(u[:], b)
+	return u, nil
+}
+
+// MapItem is one key and value of an OrderedMap.
+type MapItem struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// OrderedMap is a CBOR map which keeps its key order: the Encoder writes
+// the items in slice order without sorting, and a Decoder fills it in the
+// order the keys appear. Keys and values decode as into an interface{}, so
+// nested maps are plain Go maps. Keys need not be hashable.
+type OrderedMap []MapItem
+
+var orderedMapType = reflect.TypeOf(OrderedMap(nil))
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+var interfaceSliceType = reflect.TypeOf([]interface{}(nil))
+var emptyStructType = reflect.TypeOf(struct{}{})
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+var jsonRawMessageType = reflect.TypeOf(json.RawMessage(nil))
+var ipType = reflect.TypeOf(net.IP(nil))
+var netipAddrType = reflect.TypeOf(netip.Addr{})
+
+func (om OrderedMap) ToCBOR(w io.Writer, enc *Encoder) error {
+	err := enc.startCollection(cborMap, len(om))
+	if err != nil {
+		return err
+	}
+	for _, item := range om {
+		err = enc.Encode(item.Key)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(item.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return enc.endCollection()
+}
+
+// Decimal is a decimal fraction, Mantissa * 10^Exp, encoded as tag 4
+// around [Exp, Mantissa]. It keeps values such as money exact where a
+// float would round. A Decoder turns tag 4 into a Decimal.
+type Decimal struct {
+	Exp      int64
+	Mantissa *big.Int
+}
+
+func (d Decimal) ToCBOR(w io.Writer, enc *Encoder) error {
+	_, err := w.Write(EncodeInt(MajorTypeTag, tagDecimal, nil))
+	if err != nil {
+		return err
+	}
+	err = enc.tagAuxOut(cborArray, 2)
+	if err != nil {
+		return err
+	}
+	err = enc.writeInt(d.Exp)
+	if err != nil {
+		return err
+	}
+	if d.Mantissa == nil {
+		return enc.writeInt(0)
+	}
+	return enc.writeBignum(d.Mantissa)
+}
+
+// Format as the mantissa and a decimal exponent, e.g. "27315e-2".
+func (d Decimal) String() string {
+	m := "0"
+	if d.Mantissa != nil {
+		m = d.Mantissa.String()
+	}
+	return m + "e" + strconv.FormatInt(d.Exp, 10)
+}
+
+// Built in TagDecoder for tag 4.
+type decimalTagDecoder struct{}
+
+func (decimalTagDecoder) GetTag() uint64 { return tagDecimal }
+
+func (decimalTagDecoder) DecodeTarget() interface{} { return new([]interface{}) }
+
+func (decimalTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	parts := *(v.(*[]interface{}))
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("decimal tag 4 must hold [exponent, mantissa], got %d items", len(parts))
+	}
+	exp, m, err := expMantissa(parts, "decimal")
+	if err != nil {
+		return nil, err
+	}
+	return Decimal{Exp: exp, Mantissa: m}, nil
+}
+
+// Parse the [exponent, mantissa] pair of a decimal or bigfloat tag.
+func expMantissa(parts []interface{}, what string) (int64, *big.Int, error) {
+	var exp int64
+	switch e := parts[0].(type) {
+	case uint64:
+		if e > math.MaxInt64 {
+			return 0, nil, fmt.Errorf("%s exponent %d out of range", what, e)
+		}
+		exp = int64(e)
+	case int64:
+		exp = e
+	case Number:
+		// as decoded with UseNumber
+		i, err := e.Int64()
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s exponent %s is not an int64", what, string(e))
+		}
+		exp = i
+	default:
+		return 0, nil, fmt.Errorf("%s exponent must be an integer, got %T", what, parts[0])
+	}
+	switch m := parts[1].(type) {
+	case uint64:
+		return exp, new(big.Int).SetUint64(m), nil
+	case int64:
+		return exp, big.NewInt(m), nil
+	case big.Int:
+		return exp, &m, nil
+	case Number:
+		if bm, ok := new(big.Int).SetString(string(m), 10); ok {
+			return exp, bm, nil
+		}
+		return 0, nil, fmt.Errorf("%s mantissa %s is not an integer", what, string(m))
+	}
+	return 0, nil, fmt.Errorf("%s mantissa must be an integer or bignum, got %T", what, parts[1])
+}
+
 type Encoder struct {
 	out    io.Writer
 	filter func(v interface{}) interface{}
 
 	scratch []byte
+
+	// the buffer NewBufferedEncoder wrapped out in, reused by Reset
+	bufw *bufio.Writer
+
+	// Order in which struct fields are written. The zero value,
+	// DeclaredOrder, follows the struct definition.
+	StructKeyOrder KeyOrder
+
+	// Return an error for NaN and infinite floats, which formats such as
+	// JSON can't represent, instead of encoding them.
+	RejectNonFinite bool
+
+	// Write map entries in canonical key order, on by default. When
+	// false they are written in Go's map iteration order, skipping the
+	// extra pass which encodes every key to sort it; output is then not
+	// deterministic and duplicate encoded keys aren't detected.
+	SortKeys bool
+
+	// Tags to write around values of the given types, e.g. from
+	// RegisterStandardTagEncoders. Nil pointers are still written as
+	// null.
+	TagEncoders map[reflect.Type]TagEncoder
+
+	// Write Go slices, arrays and maps as indefinite-length items ended
+	// by a break, as the streaming API does, rather than with their
+	// length up front. It can't be combined with CanonicalOrder. Byte
+	// slices and structs are unaffected.
+	IndefiniteCollections bool
+
+	// Check that what WriteRaw and RawMessage write is exactly one
+	// well-formed item, e.g. while debugging code which splices in
+	// cached encodings. Off by default as it reads every blob.
+	ValidateRaw bool
+
+	// How time.Duration values are written. The zero value,
+	// DurationNanoseconds, writes an integer.
+	DurationMode DurationMode
+
+	// Write values implementing fmt.Stringer, and not handled by the
+	// marshaler interfaces or TagEncoders, as the text of their String
+	// method, e.g. enum names instead of numbers in CBOR logs. This is
+	// lossy: nothing decodes the text back into the original type, so
+	// only use it for output meant to be read by people.
+	UseStringer bool
+
+	// Write values implementing error, and not handled by the marshaler
+	// interfaces or TagEncoders, as the text of their Error method
+	// rather than as whatever type they are, often a struct with no
+	// exported fields. Lossy like UseStringer, and takes precedence
+	// over it.
+	EncodeErrorsAsString bool
+
+	// Write a map[T]struct{} as an array of its keys under tag 258,
+	// marking it as a set, rather than as a map of empty maps. See
+	// Decoder.DecodeSets.
+	EncodeSets bool
+
+	// Abort Encode with an error once it would write more than this many
+	// bytes, e.g. for runaway or self-referential structures. The limit
+	// applies to each top-level Encode call; zero means no limit.
+	MaxBytes int64
+
+	// the limit of the Encode call in progress, see MaxBytes
+	limit *limitWriter
+
+	// Return an error for a value which contains itself, such as a
+	// looping linked list, as encoding/json does, instead of recursing
+	// until the stack overflows. Off by default to spare acyclic data
+	// the bookkeeping.
+	DetectCycles bool
+
+	// pointers, maps and slices being written by the Encode call in
+	// progress, see DetectCycles
+	visiting map[cycleKey]struct{}
+}
+
+// Identity of a pointer, map or slice for Encoder.DetectCycles. Slices
+// sharing an array are told apart by length, like encoding/json does.
+type cycleKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// io.Writer which refuses writes beyond a byte budget, for
+// Encoder.MaxBytes.
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.n {
+		return 0, fmt.Errorf("encoding exceeds MaxBytes of %d", lw.max)
+	}
+	n, err := lw.w.Write(p)
+	lw.n -= int64(n)
+	return n, err
+}
+
+// IntDecodeMode selects the type of integers a Decoder stores in an
+// interface{}.
+type IntDecodeMode int
+
+const (
+	// uint64 for non-negative integers and int64 for negative ones.
+	IntDecodeDefault IntDecodeMode = iota
+
+	// int64 for every integer which fits, and uint64 only above
+	// math.MaxInt64, so small values compare equal to those of pipelines
+	// which use int64.
+	IntDecodeInt64
+)
+
+// FloatDecodeMode selects the Go type a Decoder gives floats decoded into
+// an interface{}. A big.Float or *big.Float target always gets a
+// big.Float.
+type FloatDecodeMode int
+
+const (
+	// float32 for half and single precision floats, float64 for double.
+	FloatDecodeDefault FloatDecodeMode = iota
+
+	// *big.Float holding the exact value, with the 53 bits of precision
+	// of a float64.
+	FloatDecodeBigFloat
+)
+
+// DurationMode selects how an Encoder writes a time.Duration. A Decoder
+// accepts either form.
+type DurationMode int
+
+const (
+	// Write the integer number of nanoseconds.
+	DurationNanoseconds DurationMode = iota
+
+	// Write the text of Duration.String, e.g. "1h30m0s", which
+	// time.ParseDuration reads back.
+	DurationString
+)
+
+// KeyOrder selects how an Encoder orders the fields of a struct.
+type KeyOrder int
+
+const (
+	// Write struct fields in the order they are declared.
+	DeclaredOrder KeyOrder = iota
+
+	// Sort struct fields by their encoded key, as canonical CBOR
+	// (RFC 7049 section 3.9) requires.
+	CanonicalOrder
+)
+
+// Options following the name in a struct tag, e.g. "omitempty" in
+// `cbor:"name,omitempty"`.
+type tagOptions string
+
+func (o tagOptions) Contains(optionName string) bool {
+	if o == "" {
+		return false
+	}
+	for _, opt := range strings.Split(string(o), ",") {
+		if opt == optionName {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the text after "name=" for an option such as "default=8080".
+func (o tagOptions) Value(name string) (string, bool) {
+	if o == "" {
+		return "", false
+	}
+	for _, opt := range strings.Split(string(o), ",") {
+		if strings.HasPrefix(opt, name+"=") {
+			return opt[len(name)+1:], true
+		}
+	}
+	return "", false
 }
 
 // parse StructField.Tag.Get("json" or "cbor")
-func fieldTagName(xinfo string) (string, bool) {
+func fieldTagName(xinfo string) (string, tagOptions, bool) {
 	if len(xinfo) != 0 {
 		// e.g. `json:"field_name,omitempty"`, or same for cbor
-		// TODO: honor 'omitempty' option
-		jiparts := strings.Split(xinfo, ",")
-		if len(jiparts) > 0 {
-			fieldName := jiparts[0]
-			if len(fieldName) > 0 {
-				return fieldName, true
-			}
+		jiparts := strings.SplitN(xinfo, ",", 2)
+		var opts tagOptions
+		if len(jiparts) > 1 {
+			opts = tagOptions(jiparts[1])
 		}
+		fieldName := jiparts[0]
+		return fieldName, opts, len(fieldName) > 0
 	}
-	return "", false
+	return "", "", false
 }
 
 // Return fieldname, bool; if bool is false, don't use this field
 func fieldname(fieldinfo reflect.StructField) (string, bool) {
+	name, _, ok := fieldnameOptions(fieldinfo)
+	return name, ok
+}
+
+// Like fieldname, also returning the tag options. Options come from the
+// cbor tag if there is one, else from the json tag.
+func fieldnameOptions(fieldinfo reflect.StructField) (string, tagOptions, bool) {
 	if fieldinfo.PkgPath != "" {
 		// has path to private package. don't export
-		return "", false
+		return "", "", false
 	}
-	fieldname, ok := fieldTagName(fieldinfo.Tag.Get("cbor"))
+	fieldname, opts, ok := fieldTagName(fieldinfo.Tag.Get("cbor"))
 	if !ok {
-		fieldname, ok = fieldTagName(fieldinfo.Tag.Get("json"))
+		var jsonOpts tagOptions
+		fieldname, jsonOpts, ok = fieldTagName(fieldinfo.Tag.Get("json"))
+		if _, hasCbor := fieldinfo.Tag.Lookup("cbor"); !hasCbor {
+			opts = jsonOpts
+		}
 	}
 	if ok {
-		if fieldname == "" {
-			return fieldinfo.Name, true
-		}
 		if fieldname == "-" {
-			return "", false
+			return "", "", false
+		}
+		return fieldname, opts, true
+	}
+	return fieldinfo.Name, opts, true
+}
+
+// Serialization details of one struct field.
+type fieldInfo struct {
+	name string
+	// index path for FieldByIndex, longer than one for fields promoted
+	// from embedded structs
+	index []int
+	opts  tagOptions
+
+	// name encoded as a CBOR text string, ready to write as a map key
+	encName []byte
+
+	// ",string" option: numbers and bools travel as text strings
+	quoted bool
+
+	// ",omitempty" option, see isEmptyValue
+	omitEmpty bool
+
+	// ",pairs" option: a map travels as an array of alternating keys
+	// and values, keeping the order of its entries on the wire
+	pairs bool
+
+	// nesting depth and whether the name came from a tag, to resolve
+	// collisions between promoted fields
+	depth  int
+	tagged bool
+
+	// ",extra" option: catch-all map for keys matching no other field
+	extra bool
+
+	// ",default=..." option: text of the value given to the field, or
+	// to what it points at, when a decoded map lacks its key. It is
+	// parsed for each decode so no two structs share a default's slice
+	// or pointer, as a net.IP or big.Int would.
+	hasDefault bool
+	defText    string
+}
+
+// Serialization details of a struct type, computed once per type by
+// getStructInfo.
+type structInfo struct {
+	// fields in declaration order
+	fields []fieldInfo
+
+	// fields sorted by encoded key, for CanonicalOrder
+	sorted []fieldInfo
+
+	// encode as a CBOR array, see `cbor:",toarray"`
+	toArray bool
+
+	// some field is promoted through an embedded pointer, which may be nil
+	viaPtr bool
+
+	// some field has the ",omitempty" option
+	omitEmpty bool
+
+	// index of the `cbor:",extra"` map field, which collects map keys
+	// matching no declared field on decode and whose entries are written
+	// back beside the fields on encode; nil if there is none
+	extra []int
+
+	// some field has the ",default=..." option
+	defaults bool
+}
+
+var structInfoCache sync.Map // map[reflect.Type]*structInfo
+
+func getStructInfo(structType reflect.Type) *structInfo {
+	if si, ok := structInfoCache.Load(structType); ok {
+		return si.(*structInfo)
+	}
+
+	si := &structInfo{}
+	for i := 0; i < structType.NumField(); i++ {
+		sf := structType.Field(i)
+		if sf.Name == "_" {
+			_, opts, _ := fieldTagName(sf.Tag.Get("cbor"))
+			if opts.Contains("toarray") {
+				si.toArray = true
+			}
+		}
+	}
+	var all []fieldInfo
+	collectFields(structType, nil, map[reflect.Type]bool{}, &all, &si.viaPtr)
+	for _, f := range dominantFields(all) {
+		if f.extra {
+			if si.extra == nil {
+				si.extra = f.index
+			}
+			continue
+		}
+		if f.omitEmpty {
+			si.omitEmpty = true
+		}
+		if f.hasDefault {
+			si.defaults = true
+		}
+		si.fields = append(si.fields, f)
+	}
+
+	si.sorted = make([]fieldInfo, len(si.fields))
+	copy(si.sorted, si.fields)
+	sort.SliceStable(si.sorted, func(i, j int) bool {
+		return CompareEncodedKeys(si.sorted[i].encName, si.sorted[j].encName) < 0
+	})
+
+	actual, _ := structInfoCache.LoadOrStore(structType, si)
+	return actual.(*structInfo)
+}
+
+// collectFields appends the fields of t in declaration order, descending
+// into embedded structs without a tag name like encoding/json does, and
+// into struct fields with the ",inline" option.
+func collectFields(t reflect.Type, index []int, visiting map[reflect.Type]bool, out *[]fieldInfo, viaPtr *bool) {
+	// an embedded pointer cycle promotes nothing new
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Name == "_" {
+			continue
+		}
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
+
+		_, cborOpts, cborNamed := fieldTagName(sf.Tag.Get("cbor"))
+		_, _, jsonNamed := fieldTagName(sf.Tag.Get("json"))
+		tagged := cborNamed || jsonNamed
+		// a named field with the ",inline" option is flattened like an
+		// embedded struct
+		inline := cborOpts.Contains("inline") && sf.PkgPath == ""
+		if (sf.Anonymous && !tagged) || inline {
+			ft := sf.Type
+			isPtr := ft.Kind() == reflect.Ptr
+			if isPtr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if isPtr {
+					*viaPtr = true
+				}
+				collectFields(ft, fieldIndex, visiting, out, viaPtr)
+				continue
+			}
+		}
+
+		name, opts, ok := fieldnameOptions(sf)
+		if !ok {
+			continue
 		}
-		return fieldname, true
+		encName := EncodeInt(MajorTypeText, uint64(len(name)), nil)
+		encName = append(encName, name...)
+		f := fieldInfo{
+			name:      name,
+			index:     fieldIndex,
+			opts:      opts,
+			encName:   encName,
+			quoted:    opts.Contains("string"),
+			omitEmpty: opts.Contains("omitempty"),
+			pairs:     opts.Contains("pairs"),
+			depth:     len(index),
+			tagged:    tagged,
+			extra:     isExtraField(sf, opts),
+		}
+		f.defText, f.hasDefault = opts.Value("default")
+		*out = append(*out, f)
+	}
+}
+
+// parseDefault converts the text of a ",default=..." option to a value
+// of type t, or of what t points at. Text is taken as is for strings,
+// parsed with strconv for bools and numbers and with time.ParseDuration
+// for a time.Duration, and otherwise handed to UnmarshalText.
+func parseDefault(t reflect.Type, text string) (reflect.Value, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	v := reflect.New(t).Elem()
+	if tu, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := tu.UnmarshalText([]byte(text)); err != nil {
+			return reflect.Value{}, fmt.Errorf("bad default %q for %s: %w", text, t.String(), err)
+		}
+		return v, nil
+	}
+	var err error
+	switch {
+	case t == durationType:
+		var d time.Duration
+		d, err = time.ParseDuration(text)
+		v.SetInt(int64(d))
+	case t.Kind() == reflect.String:
+		v.SetString(text)
+	case t.Kind() == reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(text)
+		v.SetBool(b)
+	case v.CanInt():
+		var i int64
+		i, err = strconv.ParseInt(text, 0, t.Bits())
+		v.SetInt(i)
+	case v.CanUint():
+		var u uint64
+		u, err = strconv.ParseUint(text, 0, t.Bits())
+		v.SetUint(u)
+	case v.CanFloat():
+		var f float64
+		f, err = strconv.ParseFloat(text, t.Bits())
+		v.SetFloat(f)
+	default:
+		return reflect.Value{}, fmt.Errorf("default not supported for %s", t.String())
+	}
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("bad default %q for %s: %w", text, t.String(), err)
 	}
-	return fieldinfo.Name, true
+	return v, nil
+}
+
+// An ",extra" field must be a map with string keys to hold the unknown
+// entries; the option is ignored on anything else.
+func isExtraField(sf reflect.StructField, opts tagOptions) bool {
+	return opts.Contains("extra") && sf.Type.Kind() == reflect.Map && sf.Type.Key().Kind() == reflect.String
+}
+
+// dominantFields resolves fields sharing a name: the shallowest wins, then
+// the only tagged one among the shallowest, otherwise none of them is
+// used.
+func dominantFields(all []fieldInfo) []fieldInfo {
+	byName := make(map[string][]fieldInfo)
+	for _, f := range all {
+		byName[f.name] = append(byName[f.name], f)
+	}
+	var out []fieldInfo
+	for _, f := range all {
+		group := byName[f.name]
+		if len(group) == 1 {
+			out = append(out, f)
+			continue
+		}
+		winner, ok := dominantField(group)
+		if ok && winner.depth == f.depth && sameIndex(winner.index, f.index) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func dominantField(group []fieldInfo) (fieldInfo, bool) {
+	minDepth := group[0].depth
+	for _, f := range group {
+		if f.depth < minDepth {
+			minDepth = f.depth
+		}
+	}
+	var shallow []fieldInfo
+	for _, f := range group {
+		if f.depth == minDepth {
+			shallow = append(shallow, f)
+		}
+	}
+	if len(shallow) == 1 {
+		return shallow[0], true
+	}
+	var tagged []fieldInfo
+	for _, f := range shallow {
+		if f.tagged {
+			tagged = append(tagged, f)
+		}
+	}
+	if len(tagged) == 1 {
+		return tagged[0], true
+	}
+	return fieldInfo{}, false
+}
+
+func sameIndex(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports false if a
+// nil embedded pointer is in the way.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc is like reflect.Value.FieldByIndex, allocating nil
+// embedded pointers on the way so the field can be set.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot allocate embedded %s", v.Type().String())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
 }
 
 // Write out an object to an io.Writer
@@ -1189,6 +3573,24 @@ func Dumps(ob interface{}) ([]byte, error) {
 	return writeTarget.Bytes(), nil
 }
 
+// Return the number of bytes ob encodes to, without keeping the encoding,
+// e.g. to set a Content-Length before streaming it.
+func EncodedSize(ob interface{}) (int, error) {
+	counter := &countingWriter{}
+	err := Encode(counter, ob)
+	return counter.n, err
+}
+
+// io.Writer which only counts what is written to it
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += len(p)
+	return len(p), nil
+}
+
 type MarshallValue interface {
 	// Convert the value to CBOR. Specific CBOR data (such as tags) can be written
 	// on the io.Writer and more complex datatype can be written using the
@@ -1215,11 +3617,77 @@ func (v CBORValue) ToCBOR(w io.Writer) error {
 	return err
 }
 
+// TextBytes holds UTF-8 text which is encoded as a CBOR text string rather
+// than a byte string, without first converting it to a string. It decodes
+// from either.
+type TextBytes []byte
+
+func (t TextBytes) ToCBOR(w io.Writer, enc *Encoder) error {
+	err := enc.tagAuxOut(cborText, uint64(len(t)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(t)
+	return err
+}
+
+func (t *TextBytes) UnmarshalText(text []byte) error {
+	*t = append((*t)[:0], text...)
+	return nil
+}
+
+// RawMessage is an encoded CBOR item. Decoding into one keeps the exact
+// bytes of the item, e.g. to decode a payload later once its type is
+// known, and encoding one writes it out unchanged. A nil RawMessage
+// encodes as null. The decoder's MaxLen, MaxElements and Strict settings
+// apply to the captured item.
+type RawMessage []byte
+
+func (m RawMessage) ToCBOR(w io.Writer, enc *Encoder) error {
+	if m == nil {
+		return enc.writeNull()
+	}
+	return enc.WriteRaw(m)
+}
+
 // Return new Encoder object for writing to supplied io.Writer.
 //
+// Items are written with many small Write calls, so out should be
+// buffered; see NewBufferedEncoder.
+//
 // TODO: set options on Encoder object.
 func NewEncoder(out io.Writer) *Encoder {
-	return &Encoder{out, nil, make([]byte, 9)}
+	return &Encoder{out: out, scratch: make([]byte, 9), SortKeys: true}
+}
+
+// Return new Encoder which buffers its output to out in a bufio.Writer.
+// Call Flush when done encoding.
+func NewBufferedEncoder(out io.Writer) *Encoder {
+	bufw := bufio.NewWriter(out)
+	enc := NewEncoder(bufw)
+	enc.bufw = bufw
+	return enc
+}
+
+// Reset makes the encoder write to out, keeping its options and scratch
+// space, e.g. to pool encoders in a sync.Pool. An encoder from
+// NewBufferedEncoder reuses its buffer for out, dropping anything not yet
+// flushed.
+func (enc *Encoder) Reset(out io.Writer) {
+	if enc.bufw != nil {
+		enc.bufw.Reset(out)
+		out = enc.bufw
+	}
+	enc.out = out
+}
+
+// Flush any output buffered by the underlying writer, if it has a
+// Flush() error method as bufio.Writer does.
+func (enc *Encoder) Flush() error {
+	if f, ok := enc.out.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 func (enc *Encoder) SetFilter(filter func(v interface{}) interface{}) {
@@ -1227,10 +3695,34 @@ func (enc *Encoder) SetFilter(filter func(v interface{}) interface{}) {
 }
 
 func (enc *Encoder) Encode(ob interface{}) error {
+	if enc.MaxBytes > 0 && enc.limit == nil {
+		// not for calls nested in this one, which share its budget
+		out := enc.out
+		enc.limit = &limitWriter{w: out, n: enc.MaxBytes, max: enc.MaxBytes}
+		enc.out = enc.limit
+		defer func() {
+			enc.out = out
+			enc.limit = nil
+		}()
+	}
+	if enc.DetectCycles && enc.visiting == nil {
+		enc.visiting = make(map[cycleKey]struct{})
+		defer func() { enc.visiting = nil }()
+	}
+	return enc.encode(ob)
+}
+
+func (enc *Encoder) encode(ob interface{}) error {
 	if enc.filter != nil {
 		ob = enc.filter(ob)
 	}
 
+	// a typed nil pointer is null, as in encoding/json, rather than a
+	// call to a marshaler method which may panic on it
+	if rv := reflect.ValueOf(ob); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return enc.writeNull()
+	}
+
 	if v, ok := ob.(MarshallValue); ok {
 		return v.ToCBOR(enc.out, enc)
 	} else if v, ok := ob.(SimpleMarshallValue); ok {
@@ -1268,14 +3760,104 @@ func (enc *Encoder) Encode(ob interface{}) error {
 		return enc.writeBytes(x)
 	case bool:
 		return enc.writeBool(x)
+	case Number:
+		return enc.writeNumber(x)
 	case nil:
-		return enc.tagAuxOut(cbor7, uint64(cborNull))
+		return enc.writeNull()
 	case big.Int:
-		return fmt.Errorf("TODO: encode big.Int")
+		return enc.writeBignum(&x)
+	case *big.Int:
+		if x == nil {
+			return enc.writeNull()
+		}
+		return enc.writeBignum(x)
+	}
+
+	// If none of the simple types work, try reflection
+	return enc.writeReflection(reflect.ValueOf(ob))
+}
+
+// Write items as a CBOR sequence (RFC 8742): each item is encoded in turn,
+// back to back, with no enclosing array.
+func (enc *Encoder) EncodeSequence(items ...interface{}) error {
+	for _, item := range items {
+		err := enc.Encode(item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRaw writes blob, which must be one encoded CBOR item, to the
+// output as it is. This splices in encodings made earlier, e.g. cached
+// parts of a larger message, without decoding and encoding them again.
+func (enc *Encoder) WriteRaw(blob []byte) error {
+	if enc.ValidateRaw {
+		err := validateItem(blob)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := enc.out.Write(blob)
+	return err
+}
+
+// Return an error unless blob is exactly one well-formed item.
+func validateItem(blob []byte) error {
+	r := bytes.NewReader(blob)
+	err := NewDecoder(r).Skip()
+	if err != nil {
+		return fmt.Errorf("invalid raw CBOR: %v", err)
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("invalid raw CBOR: %d bytes after the item", r.Len())
 	}
+	return nil
+}
 
-	// If none of the simple types work, try reflection
-	return enc.writeReflection(reflect.ValueOf(ob))
+// Start an indefinite-length array. Encode its items, then call
+// EndIndefinite. This lets an array be streamed without knowing its
+// length up front.
+func (enc *Encoder) StartIndefiniteArray() error {
+	return enc.writeByte(cborArray | varFollows)
+}
+
+// Start an indefinite-length map. Encode alternating keys and values,
+// then call EndIndefinite.
+func (enc *Encoder) StartIndefiniteMap() error {
+	return enc.writeByte(cborMap | varFollows)
+}
+
+// End the innermost indefinite-length array or map with a break.
+func (enc *Encoder) EndIndefinite() error {
+	return enc.writeByte(0xff)
+}
+
+// Write the head of an array or map of n items, indefinite-length if
+// IndefiniteCollections is set.
+func (enc *Encoder) startCollection(major byte, n int) error {
+	if !enc.IndefiniteCollections {
+		return enc.tagAuxOut(major, uint64(n))
+	}
+	if enc.StructKeyOrder == CanonicalOrder {
+		return fmt.Errorf("IndefiniteCollections can't be used with CanonicalOrder, which requires definite lengths")
+	}
+	return enc.writeByte(major | varFollows)
+}
+
+// Finish a collection begun with startCollection.
+func (enc *Encoder) endCollection() error {
+	if !enc.IndefiniteCollections {
+		return nil
+	}
+	return enc.EndIndefinite()
+}
+
+func (enc *Encoder) writeByte(b byte) error {
+	enc.scratch[0] = b
+	_, err := enc.out.Write(enc.scratch[:1])
+	return err
 }
 
 func (enc *Encoder) writeReflection(rv reflect.Value) error {
@@ -1284,7 +3866,44 @@ func (enc *Encoder) writeReflection(rv reflect.Value) error {
 	}
 
 	if !rv.IsValid() {
-		return enc.tagAuxOut(cbor7, uint64(cborNull))
+		return enc.writeNull()
+	}
+
+	// an interface{} element or field is written as what it holds
+	if rv.Kind() == reflect.Interface {
+		return enc.Encode(rv.Interface())
+	}
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return enc.writeNull()
+	}
+
+	if enc.visiting != nil {
+		switch rv.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice:
+			if rv.Kind() == reflect.Ptr || rv.Len() > 0 {
+				key := cycleKey{ptr: rv.Pointer(), typ: rv.Type()}
+				if rv.Kind() == reflect.Slice {
+					key.len = rv.Len()
+				}
+				if _, ok := enc.visiting[key]; ok {
+					return fmt.Errorf("encountered a cycle via %s", rv.Type().String())
+				}
+				enc.visiting[key] = struct{}{}
+				defer delete(enc.visiting, key)
+			}
+		}
+	}
+
+	if te := enc.TagEncoders[rv.Type()]; te != nil {
+		content, err := te.PreEncode(rv.Interface())
+		if err != nil {
+			return err
+		}
+		err = enc.tagAuxOut(cborTag, te.GetTag())
+		if err != nil {
+			return err
+		}
+		return enc.writeReflection(reflect.ValueOf(content))
 	}
 
 	if v, ok := rv.Interface().(MarshallValue); ok {
@@ -1293,7 +3912,45 @@ func (enc *Encoder) writeReflection(rv reflect.Value) error {
 		return v.ToCBOR(enc.out)
 	}
 
+	// before TextMarshaler, which *big.Int also implements
+	switch rv.Type() {
+	case bigIntType:
+		x := rv.Interface().(big.Int)
+		return enc.writeBignum(&x)
+	case bigIntPtrType:
+		return enc.writeBignum(rv.Interface().(*big.Int))
+	}
+
+	if tm := textMarshaler(rv); tm != nil {
+		text, err := tm.MarshalText()
+		if err != nil {
+			return err
+		}
+		err = enc.tagAuxOut(cborText, uint64(len(text)))
+		if err != nil {
+			return err
+		}
+		_, err = enc.out.Write(text)
+		return err
+	}
+
 	var err error
+	if rv.Type() == durationType && enc.DurationMode == DurationString {
+		return enc.writeText(time.Duration(rv.Int()).String())
+	}
+
+	if enc.EncodeErrorsAsString {
+		if e, ok := rv.Interface().(error); ok {
+			return enc.writeText(e.Error())
+		}
+	}
+
+	if enc.UseStringer && rv.Type() != durationType {
+		if s, ok := rv.Interface().(fmt.Stringer); ok {
+			return enc.writeText(s.String())
+		}
+	}
+
 	switch rv.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return enc.writeInt(rv.Int())
@@ -1301,6 +3958,8 @@ func (enc *Encoder) writeReflection(rv reflect.Value) error {
 		return enc.tagAuxOut(cborUint, rv.Uint())
 	case reflect.Float32, reflect.Float64:
 		return enc.writeFloat(rv.Float())
+	case reflect.Complex64, reflect.Complex128:
+		return enc.writeComplex(rv.Complex(), rv.Kind() == reflect.Complex64)
 	case reflect.Bool:
 		return enc.writeBool(rv.Bool())
 	case reflect.String:
@@ -1309,10 +3968,31 @@ func (enc *Encoder) writeReflection(rv reflect.Value) error {
 		elemType := rv.Type().Elem()
 		if elemType.Kind() == reflect.Uint8 {
 			// special case, write out []byte
+			if rv.Kind() == reflect.Array && !rv.CanAddr() {
+				// e.g. a map key, which Bytes can't take
+				b := make([]byte, rv.Len())
+				reflect.Copy(reflect.ValueOf(b), rv)
+				return enc.writeBytes(b)
+			}
 			return enc.writeBytes(rv.Bytes())
 		}
 		alen := rv.Len()
-		err = enc.tagAuxOut(cborArray, uint64(alen))
+		err = enc.startCollection(cborArray, alen)
+		if err != nil {
+			return err
+		}
+		if rv.Kind() == reflect.Slice && elemType == interfaceType {
+			// hand each element straight to Encode, skipping the
+			// reflect.Value for the interface it is stored in
+			for i, item := range rv.Convert(interfaceSliceType).Interface().([]interface{}) {
+				err = enc.Encode(item)
+				if err != nil {
+					log.Printf("error at array elem %d", i)
+					return err
+				}
+			}
+			return enc.endCollection()
+		}
 		for i := 0; i < alen; i++ {
 			err = enc.writeReflection(rv.Index(i))
 			if err != nil {
@@ -1320,105 +4000,337 @@ func (enc *Encoder) writeReflection(rv reflect.Value) error {
 				return err
 			}
 		}
-		return nil
+		return enc.endCollection()
 	case reflect.Map:
-		err = enc.tagAuxOut(cborMap, uint64(rv.Len()))
+		if enc.EncodeSets && rv.Type().Elem() == emptyStructType {
+			return enc.writeSet(rv)
+		}
+		err = enc.startCollection(cborMap, rv.Len())
 		if err != nil {
 			return err
 		}
-
-		dup := func(b []byte) []byte {
-			out := make([]byte, len(b))
-			copy(out, b)
-			return out
-		}
-
-		keys := rv.MapKeys()
-		buf := new(bytes.Buffer)
-		encKeys := make([]cborKeyEntry, 0, len(keys))
-		for _, krv := range keys {
-			tempEnc := NewEncoder(buf)
-			err := tempEnc.writeReflection(krv)
-			if err != nil {
-				log.Println("error encoding map key", err)
-				return err
-			}
-			kval := dup(buf.Bytes())
-			encKeys = append(encKeys, cborKeyEntry{
-				val: kval,
-				key: krv,
-			})
-			buf.Reset()
+		err = enc.writeMapEntries(rv, true)
+		if err != nil {
+			return err
 		}
-
-		sort.Sort(cborKeySorter(encKeys))
-
-		for _, ek := range encKeys {
-			vrv := rv.MapIndex(ek.key)
-
-			_, err := enc.out.Write(ek.val)
+		return enc.endCollection()
+	case reflect.Struct:
+		si := getStructInfo(rv.Type())
+		if si.toArray {
+			err = enc.tagAuxOut(cborArray, uint64(len(si.fields)))
 			if err != nil {
-				log.Printf("error writing map key")
 				return err
 			}
-			err = enc.writeReflection(vrv)
-			if err != nil {
-				log.Printf("error encoding map val")
-				return err
+			for _, field := range si.fields {
+				fv, ok := fieldByIndex(rv, field.index)
+				if !ok {
+					// behind a nil embedded pointer
+					err = enc.writeNull()
+				} else {
+					err = enc.writeField(fv, field)
+				}
+				if err != nil {
+					return err
+				}
 			}
+			return nil
 		}
-
-		return nil
-	case reflect.Struct:
-		// TODO: check for big.Int ?
-		numfields := rv.NumField()
-		structType := rv.Type()
-		usableFields := 0
-		for i := 0; i < numfields; i++ {
-			fieldinfo := structType.Field(i)
-			_, ok := fieldname(fieldinfo)
-			if !ok {
-				continue
+		fields := si.fields
+		if enc.StructKeyOrder == CanonicalOrder {
+			fields = si.sorted
+		}
+		count := len(fields)
+		if si.viaPtr || si.omitEmpty {
+			// fields behind nil embedded pointers and empty omitempty
+			// fields are left out
+			count = 0
+			for _, field := range fields {
+				if _, ok := fieldToWrite(rv, field); ok {
+					count++
+				}
 			}
-			usableFields++
 		}
-		err = enc.tagAuxOut(cborMap, uint64(usableFields))
+		extras := extraEntries(rv, si)
+		err = enc.tagAuxOut(cborMap, uint64(count+len(extras)))
 		if err != nil {
 			return err
 		}
-		for i := 0; i < numfields; i++ {
-			fieldinfo := structType.Field(i)
-			fieldname, ok := fieldname(fieldinfo)
+		next := 0
+		for _, field := range fields {
+			fv, ok := fieldToWrite(rv, field)
 			if !ok {
 				continue
 			}
-			err = enc.writeText(fieldname)
+			// in canonical order the extra entries go between the fields
+			for ; enc.StructKeyOrder == CanonicalOrder && next < len(extras) && CompareEncodedKeys(extras[next].val, field.encName) < 0; next++ {
+				err = enc.writeExtraEntry(extras[next])
+				if err != nil {
+					return err
+				}
+			}
+			_, err = enc.out.Write(field.encName)
+			if err != nil {
+				return err
+			}
+			err = enc.writeField(fv, field)
 			if err != nil {
 				return err
 			}
-			err = enc.writeReflection(rv.Field(i))
+		}
+		for ; next < len(extras); next++ {
+			err = enc.writeExtraEntry(extras[next])
 			if err != nil {
 				return err
 			}
 		}
 		return nil
-	case reflect.Interface:
-		//return fmt.Errorf("TODO: serialize interface{} k=%s T=%s", rv.Kind().String(), rv.Type().String())
-		return enc.Encode(rv.Interface())
 	case reflect.Ptr:
-		if rv.IsNil() {
-			return enc.tagAuxOut(cbor7, uint64(cborNull))
-		}
 		return enc.writeReflection(reflect.Indirect(rv))
 	}
 
 	return fmt.Errorf("don't know how to CBOR serialize k=%s t=%s", rv.Kind().String(), rv.Type().String())
 }
 
+// Return the entries of the ",extra" map of struct rv in canonical key
+// order, leaving out any whose key is a declared field's name so no key
+// is written twice.
+func extraEntries(rv reflect.Value, si *structInfo) []cborKeyEntry {
+	if si.extra == nil {
+		return nil
+	}
+	mv, ok := fieldByIndex(rv, si.extra)
+	if !ok || mv.Len() == 0 {
+		return nil
+	}
+	declared := make(map[string]bool, len(si.fields))
+	for _, f := range si.fields {
+		declared[f.name] = true
+	}
+	var out []cborKeyEntry
+	iter := mv.MapRange()
+	for iter.Next() {
+		name := iter.Key().String()
+		if declared[name] {
+			continue
+		}
+		encName := EncodeInt(MajorTypeText, uint64(len(name)), nil)
+		out = append(out, cborKeyEntry{
+			val:   append(encName, name...),
+			key:   iter.Key(),
+			value: iter.Value(),
+		})
+	}
+	sort.Sort(cborKeySorter(out))
+	return out
+}
+
+func (enc *Encoder) writeExtraEntry(ek cborKeyEntry) error {
+	_, err := enc.out.Write(ek.val)
+	if err != nil {
+		return err
+	}
+	return enc.writeReflection(ek.value)
+}
+
+// Write a map[T]struct{} as a set: tag 258 around an array of its keys.
+func (enc *Encoder) writeSet(rv reflect.Value) error {
+	err := enc.tagAuxOut(cborTag, tagSet)
+	if err != nil {
+		return err
+	}
+	err = enc.startCollection(cborArray, rv.Len())
+	if err != nil {
+		return err
+	}
+	err = enc.writeMapEntries(rv, false)
+	if err != nil {
+		return err
+	}
+	return enc.endCollection()
+}
+
+// Write the keys and, if values is set, the values of a map, in canonical
+// key order if SortKeys is set.
+func (enc *Encoder) writeMapEntries(rv reflect.Value, values bool) error {
+	var err error
+	if !enc.SortKeys {
+		iter := rv.MapRange()
+		for iter.Next() {
+			err = enc.writeReflection(iter.Key())
+			if err != nil {
+				return err
+			}
+			if !values {
+				continue
+			}
+			err = enc.writeReflection(iter.Value())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dup := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		copy(out, b)
+		return out
+	}
+
+	buf := new(bytes.Buffer)
+	encKeys := make([]cborKeyEntry, 0, rv.Len())
+	// keys are encoded with every option of enc, only into buf
+	keyEnc := *enc
+	keyEnc.out = buf
+	// iterate rather than MapIndex, which can't find NaN keys
+	iter := rv.MapRange()
+	for iter.Next() {
+		err := keyEnc.writeReflection(iter.Key())
+		if err != nil {
+			log.Println("error encoding map key", err)
+			return err
+		}
+		kval := dup(buf.Bytes())
+		encKeys = append(encKeys, cborKeyEntry{
+			val:   kval,
+			key:   iter.Key(),
+			value: iter.Value(),
+		})
+		buf.Reset()
+	}
+
+	sort.Sort(cborKeySorter(encKeys))
+
+	for i, ek := range encKeys {
+		// distinct Go keys such as int(1) and uint64(1) in a
+		// map[interface{}]interface{} can encode the same
+		if i > 0 && bytes.Equal(ek.val, encKeys[i-1].val) {
+			return fmt.Errorf("duplicate map key %x from %#v and %#v", ek.val, encKeys[i-1].key.Interface(), ek.key.Interface())
+		}
+
+		_, err := enc.out.Write(ek.val)
+		if err != nil {
+			log.Printf("error writing map key")
+			return err
+		}
+		if !values {
+			continue
+		}
+		err = enc.writeReflection(ek.value)
+		if err != nil {
+			log.Printf("error encoding map val")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Return the value of a struct field to write to a map, or false if it is
+// left out.
+func fieldToWrite(rv reflect.Value, field fieldInfo) (reflect.Value, bool) {
+	fv, ok := fieldByIndex(rv, field.index)
+	if !ok || (field.omitEmpty && isEmptyValue(fv)) {
+		return reflect.Value{}, false
+	}
+	return fv, true
+}
+
+// The "omitempty" test, as in encoding/json: false, 0, "", and nil or
+// empty arrays, slices and maps are empty, as are nil pointers and
+// interfaces. A non-nil pointer is never empty, even to a zero value.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func (enc *Encoder) writeField(fv reflect.Value, field fieldInfo) error {
+	if field.pairs {
+		return enc.writePairs(fv)
+	}
+	if !field.quoted {
+		return enc.writeReflection(fv)
+	}
+	for fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return enc.writeNull()
+		}
+		fv = fv.Elem()
+	}
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return enc.writeText(strconv.FormatInt(fv.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return enc.writeText(strconv.FormatUint(fv.Uint(), 10))
+	case reflect.Float32:
+		return enc.writeText(strconv.FormatFloat(fv.Float(), 'g', -1, 32))
+	case reflect.Float64:
+		return enc.writeText(strconv.FormatFloat(fv.Float(), 'g', -1, 64))
+	case reflect.Bool:
+		return enc.writeText(strconv.FormatBool(fv.Bool()))
+	}
+	// the option only applies to numbers and bools
+	return enc.writeReflection(fv)
+}
+
+// Write a map as an array of alternating keys and values, for a struct
+// field with the ",pairs" option. Anything else is written as usual.
+func (enc *Encoder) writePairs(fv reflect.Value) error {
+	for fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return enc.writeNull()
+		}
+		fv = fv.Elem()
+	}
+	if fv.Kind() != reflect.Map || fv.IsNil() {
+		return enc.writeReflection(fv)
+	}
+	err := enc.startCollection(cborArray, 2*fv.Len())
+	if err != nil {
+		return err
+	}
+	err = enc.writeMapEntries(fv, true)
+	if err != nil {
+		return err
+	}
+	return enc.endCollection()
+}
+
+// Return the value as an encoding.TextMarshaler, trying its address for
+// pointer receivers, or nil if it doesn't implement that. Nil pointers are
+// left to be written as null.
+func textMarshaler(rv reflect.Value) encoding.TextMarshaler {
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	if tm, ok := rv.Interface().(encoding.TextMarshaler); ok {
+		return tm
+	}
+	if rv.Kind() != reflect.Ptr && rv.CanAddr() {
+		tm, _ := rv.Addr().Interface().(encoding.TextMarshaler)
+		return tm
+	}
+	return nil
+}
+
 type cborKeySorter []cborKeyEntry
 type cborKeyEntry struct {
-	val []byte
-	key reflect.Value
+	val   []byte
+	key   reflect.Value
+	value reflect.Value
 }
 
 func (cks cborKeySorter) Len() int { return len(cks) }
@@ -1427,36 +4339,23 @@ func (cks cborKeySorter) Swap(i, j int) {
 }
 
 func (cks cborKeySorter) Less(i, j int) bool {
-	a := keyBytesFromEncoded(cks[i].val)
-	b := keyBytesFromEncoded(cks[j].val)
-	switch {
-	case len(a) < len(b):
-		return true
-	case len(a) > len(b):
-		return false
-	default:
-		if bytes.Compare(a, b) < 0 {
-			return true
-		}
-		return false
-	}
+	return CompareEncodedKeys(cks[i].val, cks[j].val) < 0
 }
 
-func keyBytesFromEncoded(data []byte) []byte {
-	cborInfo := data[0] & infoBits
-
-	if cborInfo <= 23 {
-		return data[1:]
-	} else if cborInfo == int8Follows {
-		return data[2:]
-	} else if cborInfo == int16Follows {
-		return data[3:]
-	} else if cborInfo == int32Follows {
-		return data[5:]
-	} else if cborInfo == int64Follows {
-		return data[9:]
+// CompareEncodedKeys compares two encoded map keys in canonical CBOR
+// order (RFC 7049 section 3.9), the order an Encoder with SortKeys or
+// CanonicalOrder writes them in, returning -1, 0 or +1. Shorter encodings
+// come first, then bytewise over the whole encoding, header included, so
+// keys of any major type, indefinite length ones too, get a total order.
+// The keys aren't checked to be well formed.
+func CompareEncodedKeys(a, b []byte) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
 	}
-	panic("shouldnt actually hit this")
+	return bytes.Compare(a, b)
 }
 
 func (enc *Encoder) writeInt(x int64) error {
@@ -1472,16 +4371,16 @@ func (enc *Encoder) tagAuxOut(tag byte, x uint64) error {
 		// tiny literal
 		enc.scratch[0] = tag | byte(x)
 		_, err = enc.out.Write(enc.scratch[:1])
-	} else if x < 0x0ff {
+	} else if x < 0x100 {
 		enc.scratch[0] = tag | int8Follows
 		enc.scratch[1] = byte(x & 0x0ff)
 		_, err = enc.out.Write(enc.scratch[:2])
-	} else if x < 0x0ffff {
+	} else if x < 0x10000 {
 		enc.scratch[0] = tag | int16Follows
 		enc.scratch[1] = byte((x >> 8) & 0x0ff)
 		enc.scratch[2] = byte(x & 0x0ff)
 		_, err = enc.out.Write(enc.scratch[:3])
-	} else if x < 0x0ffffffff {
+	} else if x < 0x100000000 {
 		enc.scratch[0] = tag | int32Follows
 		enc.scratch[1] = byte((x >> 24) & 0x0ff)
 		enc.scratch[2] = byte((x >> 16) & 0x0ff)
@@ -1522,11 +4421,11 @@ func EncodeInt(tag byte, v uint64, buf []byte) []byte {
 	case v <= 23:
 		// tiny literal
 		return EncodeOpcode(tag, byte(v), buf)
-	case 23 < v && v < 0x0ff:
+	case v < 0x100:
 		return EncodeInt8(tag, uint8(v), buf)
-	case 0xff <= v && v < 0x0ffff:
+	case v < 0x10000:
 		return EncodeInt16(tag, uint16(v), buf)
-	case 0xffff <= v && v < 0x0ffffffff:
+	case v < 0x100000000:
 		return EncodeInt32(tag, uint32(v), buf)
 	default:
 		return EncodeInt64(tag, v, buf)
@@ -1606,15 +4505,96 @@ func (enc *Encoder) writeBytes(x []byte) error {
 }
 
 func (enc *Encoder) writeFloat(x float64) error {
+	if enc.RejectNonFinite && (math.IsNaN(x) || math.IsInf(x, 0)) {
+		return fmt.Errorf("cannot encode non-finite float %v", x)
+	}
 	return enc.tagAux64(cbor7, math.Float64bits(x))
 }
 
+// CBOR has no complex type, so write [real, imag]. The parts of a
+// complex64 are written as float32.
+func (enc *Encoder) writeComplex(x complex128, single bool) error {
+	err := enc.tagAuxOut(cborArray, 2)
+	if err != nil {
+		return err
+	}
+	for _, f := range []float64{real(x), imag(x)} {
+		if !single {
+			err = enc.writeFloat(f)
+		} else if enc.RejectNonFinite && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			err = fmt.Errorf("cannot encode non-finite float %v", f)
+		} else {
+			_, err = enc.out.Write(EncodeInt32(MajorTypeFloat, math.Float32bits(float32(f)), enc.scratch))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write an integer in the smallest form that holds it: a plain integer
+// when it fits in 64 bits, else a tag 2 or 3 bignum.
+func (enc *Encoder) writeBignum(x *big.Int) error {
+	tag := tagBignum
+	major := cborUint
+	if x.Sign() < 0 {
+		// negatives are encoded as -1 - n
+		x = new(big.Int).Sub(big.NewInt(-1), x)
+		tag = tagNegBignum
+		major = cborNegint
+	}
+	if x.IsUint64() {
+		return enc.tagAuxOut(major, x.Uint64())
+	}
+	err := enc.tagAuxOut(cborTag, tag)
+	if err != nil {
+		return err
+	}
+	return enc.writeBytes(x.Bytes())
+}
+
+func (enc *Encoder) writeNumber(x Number) error {
+	if i, err := x.Int64(); err == nil {
+		return enc.writeInt(i)
+	}
+	if u, err := x.Uint64(); err == nil {
+		return enc.tagAuxOut(cborUint, u)
+	}
+	if bn, ok := new(big.Int).SetString(string(x), 10); ok {
+		return enc.writeBignum(bn)
+	}
+	f, err := x.Float64()
+	if err != nil {
+		return fmt.Errorf("invalid cbor.Number %q", string(x))
+	}
+	return enc.writeFloat(f)
+}
+
 func (enc *Encoder) writeBool(x bool) error {
 	if x {
-		return enc.tagAuxOut(cbor7, uint64(cborTrue))
-	} else {
-		return enc.tagAuxOut(cbor7, uint64(cborFalse))
+		return enc.writeSimple(cborTrue)
+	}
+	return enc.writeSimple(cborFalse)
+}
+
+func (enc *Encoder) writeNull() error {
+	return enc.writeSimple(cborNull)
+}
+
+// Write simple value v, in the initial byte for values below 24 and in a
+// following byte otherwise. 24 to 31 have no valid encoding.
+func (enc *Encoder) writeSimple(v uint8) error {
+	if v < 24 {
+		return enc.writeByte(cbor7 | v)
 	}
+	if v < 32 {
+		return fmt.Errorf("simple value %d is reserved", v)
+	}
+	enc.scratch[0] = cbor7 | int8Follows
+	enc.scratch[1] = v
+	_, err := enc.out.Write(enc.scratch[:2])
+	return err
 }
 
 func min(x, y uint64) uint64 {
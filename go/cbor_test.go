@@ -4,14 +4,23 @@ import "bytes"
 import "encoding/base64"
 import "encoding/hex"
 import "encoding/json"
+import "errors"
 import "fmt"
+import "io"
 import "log"
 import "math"
 import "math/big"
+import "net"
+import "net/netip"
+import "net/url"
 import "os"
 import "reflect"
+import "runtime"
+import "strconv"
 import "strings"
+import "sync"
 import "testing"
+import "time"
 
 type testVector struct {
 	Cbor string
@@ -617,8 +626,4403 @@ func TestIncorrectSize(t *testing.T) {
 	dec = NewDecoder(bytes.NewReader(bin))
 
 	err = dec.Decode(&outBytes)
-	if err.Error() != "EOF" {
+	if err.Error() != "unexpected EOF" {
 		t.Fatal("unexpected error decoding cbor b64", err)
 		return
 	}
 }
+
+type keyOrderStruct struct {
+	Zeta int
+	A    int
+	Mid  int
+}
+
+func TestStructKeyOrder(t *testing.T) {
+	ob := keyOrderStruct{1, 2, 3}
+
+	buf := &bytes.Buffer{}
+	err := NewEncoder(buf).Encode(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := "a3645a65746101614102634d696403"
+	if hex.EncodeToString(buf.Bytes()) != declared {
+		t.Errorf("declared order: wanted %s got %x", declared, buf.Bytes())
+	}
+
+	buf.Reset()
+	enc := NewEncoder(buf)
+	enc.StructKeyOrder = CanonicalOrder
+	err = enc.Encode(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonical := "a3614102634d696403645a65746101"
+	if hex.EncodeToString(buf.Bytes()) != canonical {
+		t.Errorf("canonical order: wanted %s got %x", canonical, buf.Bytes())
+	}
+
+	var out keyOrderStruct
+	err = Loads(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != ob {
+		t.Errorf("%#v != %#v", out, ob)
+	}
+}
+
+type toArrayStruct struct {
+	_       struct{} `cbor:",toarray"`
+	Name    string
+	Count   int
+	skipped int
+	Tags    []string
+}
+
+func TestStructToArray(t *testing.T) {
+	ob := toArrayStruct{Name: "x", Count: 7, Tags: []string{"a"}}
+
+	blob, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "83617807816161"
+	if hex.EncodeToString(blob) != expected {
+		t.Errorf("wanted %s got %x", expected, blob)
+	}
+
+	var out toArrayStruct
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ob, out) {
+		t.Errorf("%#v != %#v", ob, out)
+	}
+
+	tooLong, _ := hex.DecodeString("8461780781616101")
+	err = Loads(tooLong, &out)
+	if err == nil {
+		t.Error("expected error decoding too many elements into toarray struct")
+	}
+}
+
+type benchStruct12 struct {
+	A string
+	B int
+	C uint64
+	D float64
+	E bool
+	F string `cbor:"f_field"`
+	G int64
+	H []int
+	I map[string]int
+	J string `json:"j_field"`
+	K int32
+	L []byte
+}
+
+var benchOb12 = benchStruct12{
+	"a", -1, 2, 3.5, true, "f", 7, []int{1, 2}, map[string]int{"x": 1},
+	"j", 11, []byte{1, 2, 3},
+}
+
+func BenchmarkEncodeStruct12(b *testing.B) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := enc.Encode(benchOb12)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeStruct12(b *testing.B) {
+	blob, err := Dumps(benchOb12)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out benchStruct12
+		err = Loads(blob, &out)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type ptrFieldStruct struct {
+	I *int
+	S *string
+	F *float64
+	B *bool
+	N *int64
+}
+
+func TestDecodeNilPointers(t *testing.T) {
+	blob, err := Dumps(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pi *int
+	err = Loads(blob, &pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi == nil || *pi != 7 {
+		t.Errorf("*int wanted 7 got %v", pi)
+	}
+
+	var ppi **int
+	err = Loads(blob, &ppi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ppi == nil || *ppi == nil || **ppi != 7 {
+		t.Errorf("**int wanted 7 got %v", ppi)
+	}
+
+	blob, err = Dumps("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ps *string
+	err = Loads(blob, &ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps == nil || *ps != "hello" {
+		t.Errorf("*string wanted hello got %v", ps)
+	}
+
+	blob, err = Dumps(map[string]interface{}{
+		"I": 1, "S": "s", "F": 0.5, "B": true, "N": -5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ob ptrFieldStruct
+	err = Loads(blob, &ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ob.I == nil || *ob.I != 1 {
+		t.Errorf("I wanted 1 got %v", ob.I)
+	}
+	if ob.S == nil || *ob.S != "s" {
+		t.Errorf("S wanted s got %v", ob.S)
+	}
+	if ob.F == nil || *ob.F != 0.5 {
+		t.Errorf("F wanted 0.5 got %v", ob.F)
+	}
+	if ob.B == nil || *ob.B != true {
+		t.Errorf("B wanted true got %v", ob.B)
+	}
+	if ob.N == nil || *ob.N != -5 {
+		t.Errorf("N wanted -5 got %v", ob.N)
+	}
+}
+
+func TestDecodeBool(t *testing.T) {
+	blob, err := Dumps(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bool
+	err = Loads(blob, &b)
+	if err != nil || !b {
+		t.Errorf("bool wanted true got %v (%v)", b, err)
+	}
+
+	var pb *bool
+	err = Loads(blob, &pb)
+	if err != nil || pb == nil || !*pb {
+		t.Errorf("*bool wanted true got %v (%v)", pb, err)
+	}
+
+	var i int
+	err = Loads(blob, &i)
+	if err == nil {
+		t.Error("expected error decoding bool into int")
+	}
+
+	var s struct{ Flag string }
+	blob, err = Dumps(map[string]interface{}{"Flag": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Loads(blob, &s)
+	if err == nil {
+		t.Error("expected error decoding bool into string field")
+	}
+}
+
+type upperText struct {
+	s string
+}
+
+func (u *upperText) UnmarshalText(text []byte) error {
+	u.s = strings.ToUpper(string(text))
+	return nil
+}
+
+func TestDecodeTextUnmarshaler(t *testing.T) {
+	blob, err := Dumps("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u upperText
+	err = Loads(blob, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.s != "HELLO" {
+		t.Errorf("wanted HELLO got %#v", u.s)
+	}
+
+	blob, err = Dumps([]byte("bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pu *upperText
+	err = Loads(blob, &pu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pu == nil || pu.s != "BYTES" {
+		t.Errorf("wanted BYTES got %#v", pu)
+	}
+
+	when := time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)
+	blob, err = Dumps(map[string]interface{}{"When": "2013-03-21T20:04:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ob struct{ When time.Time }
+	err = Loads(blob, &ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ob.When.Equal(when) {
+		t.Errorf("wanted %v got %v", when, ob.When)
+	}
+
+	blob, err = Dumps("not a time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Loads(blob, &ob.When)
+	if err == nil {
+		t.Error("expected error from UnmarshalText")
+	}
+}
+
+type valueText int
+
+func (v valueText) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("v%d", int(v))), nil
+}
+
+type ptrText struct {
+	n int
+}
+
+func (p *ptrText) MarshalText() ([]byte, error) {
+	if p.n < 0 {
+		return nil, fmt.Errorf("negative ptrText")
+	}
+	return []byte(fmt.Sprintf("p%d", p.n)), nil
+}
+
+type textMarshalStruct struct {
+	When  time.Time
+	Addr  net.IP
+	Val   valueText
+	Ptr   ptrText
+	NilP  *ptrText
+	Other *ptrText
+}
+
+func TestEncodeTextMarshaler(t *testing.T) {
+	ob := textMarshalStruct{
+		When:  time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC),
+		Addr:  net.IPv4(192, 0, 2, 1),
+		Val:   3,
+		Ptr:   ptrText{4},
+		Other: &ptrText{5},
+	}
+	blob, err := Dumps(&ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]interface{})
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"When":  "2013-03-21T20:04:00Z",
+		"Addr":  "192.0.2.1",
+		"Val":   "v3",
+		"Ptr":   "p4",
+		"NilP":  nil,
+		"Other": "p5",
+	}
+	if !reflect.DeepEqual(expected, out) {
+		t.Errorf("wanted %#v got %#v", expected, out)
+	}
+
+	_, err = Dumps(&ptrText{-1})
+	if err == nil {
+		t.Error("expected MarshalText error to be returned")
+	}
+}
+
+func TestSequence(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	err := enc.EncodeSequence("one", 2, []int{3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "636f6e6502820304"
+	if hex.EncodeToString(buf.Bytes()) != expected {
+		t.Errorf("wanted %s got %x", expected, buf.Bytes())
+	}
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	var s string
+	var i int
+	var a []int
+	err = dec.Decode(&s)
+	if err != nil || s != "one" {
+		t.Errorf("first item wanted \"one\" got %#v (%v)", s, err)
+	}
+	err = dec.Decode(&i)
+	if err != nil || i != 2 {
+		t.Errorf("second item wanted 2 got %#v (%v)", i, err)
+	}
+	err = dec.Decode(&a)
+	if err != nil || !reflect.DeepEqual(a, []int{3, 4}) {
+		t.Errorf("third item wanted [3 4] got %#v (%v)", a, err)
+	}
+	var extra interface{}
+	err = dec.Decode(&extra)
+	if err != io.EOF {
+		t.Errorf("wanted io.EOF at end of sequence, got %v", err)
+	}
+
+	s, i, a = "", 0, nil
+	dec = NewDecoder(bytes.NewReader(buf.Bytes()))
+	err = dec.DecodeSequence(&s, &i, &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "one" || i != 2 || !reflect.DeepEqual(a, []int{3, 4}) {
+		t.Errorf("DecodeSequence got %#v %#v %#v", s, i, a)
+	}
+}
+
+type testShape interface {
+	Area() float64
+}
+
+type testSquare struct {
+	Side float64
+}
+
+func (s *testSquare) Area() float64 { return s.Side * s.Side }
+
+func TestDecodeInterfaceValues(t *testing.T) {
+	blob, err := Dumps(map[string]interface{}{
+		"a": map[string]interface{}{"Side": 2.0},
+		"b": map[string]interface{}{"Side": 3.0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no factory: a clean error rather than a panic
+	var shapes map[string]testShape
+	err = Loads(blob, &shapes)
+	if err == nil {
+		t.Error("expected error decoding into interface without factory")
+	}
+
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.RegisterInterface((*testShape)(nil), func() interface{} { return &testSquare{} })
+	shapes = nil
+	err = dec.Decode(&shapes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shapes) != 2 || shapes["a"].Area() != 4 || shapes["b"].Area() != 9 {
+		t.Errorf("got %#v", shapes)
+	}
+
+	blob, err = Dumps([]interface{}{map[string]interface{}{"Side": 1.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []testShape
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.RegisterInterface((*testShape)(nil), func() interface{} { return &testSquare{} })
+	err = dec.Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Area() != 2.25 {
+		t.Errorf("got %#v", list)
+	}
+
+	blob, err = Dumps(map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers map[string]testShape
+	err = Loads(blob, &numbers)
+	if err == nil {
+		t.Error("expected error decoding uint into interface it doesn't implement")
+	}
+}
+
+func TestStrictIndefinite(t *testing.T) {
+	indefinite := []string{
+		"5f42010243030405ff",         // bytes
+		"7f657374726561646d696e67ff", // text
+		"9f0102ff",                   // array
+		"bf6161f5ff",                 // map
+	}
+	for _, h := range indefinite {
+		blob, _ := hex.DecodeString(h)
+		var out interface{}
+		err := Loads(blob, &out)
+		if err != nil {
+			t.Errorf("%s: lenient decode failed: %v", h, err)
+		}
+
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.Strict = true
+		err = dec.Decode(&out)
+		if err == nil {
+			t.Errorf("%s: expected strict mode to reject indefinite length", h)
+		}
+	}
+
+	// definite items still decode
+	blob, _ := hex.DecodeString("a26161016162820203")
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.Strict = true
+	var out interface{}
+	err := dec.Decode(&out)
+	if err != nil {
+		t.Errorf("strict decode of definite map failed: %v", err)
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	// [18446744073709551615, -5, 1.5 (half), 100000.0 (single), 1.1, -18446744073709551617]
+	blob, _ := hex.DecodeString("881bffffffffffffffff24f93e00fa47c35000fb3ff199999999999ac349010000000000000000f97c00f98000")
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.UseNumber = true
+	var out []interface{}
+	err := dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		Number("18446744073709551615"),
+		Number("-5"),
+		Number("1.5"),
+		Number("100000.0"),
+		Number("1.1"),
+		Number("-18446744073709551617"),
+		Number("+Inf"),
+		Number("-0.0"),
+	}
+	if !reflect.DeepEqual(expected, out) {
+		t.Errorf("wanted %#v got %#v", expected, out)
+	}
+
+	if i, err := out[1].(Number).Int64(); err != nil || i != -5 {
+		t.Errorf("Int64 wanted -5 got %d (%v)", i, err)
+	}
+	if u, err := out[0].(Number).Uint64(); err != nil || u != 0xffffffffffffffff {
+		t.Errorf("Uint64 wanted max uint64 got %d (%v)", u, err)
+	}
+
+	// typed Number targets work without the option
+	var n struct{ N Number }
+	blob, err = Dumps(map[string]interface{}{"N": 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Loads(blob, &n)
+	if err != nil || n.N != "42" {
+		t.Errorf("Number field wanted 42 got %#v (%v)", n.N, err)
+	}
+
+	// and encode back to the same numbers
+	again, err := Dumps(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec = NewDecoder(bytes.NewReader(again))
+	dec.UseNumber = true
+	var back []interface{}
+	err = dec.Decode(&back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, back) {
+		t.Errorf("wanted %#v got %#v", expected, back)
+	}
+}
+
+type valueTagDecoder struct{}
+
+func (d valueTagDecoder) GetTag() uint64 { return 1001 }
+
+// a non-pointer target, which nothing can be decoded into
+func (d valueTagDecoder) DecodeTarget() interface{} { return RefTestOb{} }
+
+func (d valueTagDecoder) PostDecode(v interface{}) (interface{}, error) { return v, nil }
+
+type nestedUnexported struct {
+	Pub    int
+	nested struct {
+		X int
+	}
+}
+
+func TestDecodeUnsettableNested(t *testing.T) {
+	// 1001({"AString": "x"})
+	blob, _ := hex.DecodeString("d903e9a16741537472696e676178")
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.TagDecoders[1001] = valueTagDecoder{}
+	var out interface{}
+	err := dec.Decode(&out)
+	if err == nil {
+		t.Error("expected error decoding into non-pointer tag target")
+	}
+
+	blob, err = Dumps(map[string]interface{}{
+		"Pub":     1,
+		"nested":  map[string]interface{}{"X": 2},
+		"Unknown": []interface{}{1, 2, 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ob nestedUnexported
+	err = Loads(blob, &ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ob.Pub != 1 || ob.nested.X != 0 {
+		t.Errorf("got %#v", ob)
+	}
+}
+
+func TestBignumRoundTrip(t *testing.T) {
+	cases := []struct {
+		n   string
+		hex string
+	}{
+		{"0", "00"},
+		{"18446744073709551615", "1bffffffffffffffff"},
+		{"18446744073709551616", "c249010000000000000000"},
+		{"-1", "20"},
+		{"-9223372036854775809", "3b8000000000000000"},
+		{"-18446744073709551616", "3bffffffffffffffff"},
+		{"-18446744073709551617", "c349010000000000000000"},
+	}
+	for _, c := range cases {
+		bn, _ := new(big.Int).SetString(c.n, 10)
+		blob, err := Dumps(bn)
+		if err != nil {
+			t.Errorf("%s: %v", c.n, err)
+			continue
+		}
+		if hex.EncodeToString(blob) != c.hex {
+			t.Errorf("%s: wanted %s got %x", c.n, c.hex, blob)
+		}
+
+		// values beyond int64 come back as big.Int and re-encode
+		// identically
+		var out interface{}
+		err = Loads(blob, &out)
+		if err != nil {
+			t.Errorf("%s: %v", c.n, err)
+			continue
+		}
+		again, err := Dumps(out)
+		if err != nil {
+			t.Errorf("%s: re-encode %T: %v", c.n, out, err)
+			continue
+		}
+		if !bytes.Equal(blob, again) {
+			t.Errorf("%s: re-encoded %x != %x", c.n, again, blob)
+		}
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	obs := []interface{}{
+		0, -1000, "hello", []byte{1, 2, 3}, referenceObOne,
+		map[string]interface{}{"a": []interface{}{1.5, true, nil}},
+	}
+	for _, ob := range obs {
+		blob, err := Dumps(ob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := EncodedSize(ob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(blob) {
+			t.Errorf("EncodedSize(%#v) = %d, wanted %d", ob, n, len(blob))
+		}
+	}
+
+	_, err := EncodedSize(make(chan int))
+	if err == nil {
+		t.Error("expected error for unencodable value")
+	}
+}
+
+func TestTransparentTags(t *testing.T) {
+	// 1000(2(h'010000000000000000')), a bignum under an unknown tag
+	blob, _ := hex.DecodeString("d903e8c249010000000000000000")
+
+	var wrapped interface{}
+	err := Loads(blob, &wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, ok := wrapped.(*CBORTag); !ok || tag.Tag != 1000 {
+		t.Errorf("wanted CBORTag 1000 got %#v", wrapped)
+	}
+
+	var bn big.Int
+	err = Loads(blob, &bn)
+	if err == nil {
+		t.Error("expected error decoding tag envelope into big.Int")
+	}
+
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.TransparentTags[1000] = true
+	err = dec.Decode(&bn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bn.String() != "18446744073709551616" {
+		t.Errorf("wanted 2^64 got %s", bn.String())
+	}
+
+	// 1001("x") isn't transparent, unless all unknown tags are
+	blob, _ = hex.DecodeString("d903e96178")
+	var s string
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.TransparentTags[1000] = true
+	err = dec.Decode(&s)
+	if err == nil {
+		t.Error("expected error decoding tag 1001 into string")
+	}
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.UnwrapUnknownTags = true
+	err = dec.Decode(&s)
+	if err != nil || s != "x" {
+		t.Errorf("wanted \"x\" got %#v (%v)", s, err)
+	}
+}
+
+func TestTruncatedInput(t *testing.T) {
+	truncated := []string{
+		"18",       // uint missing its 1-byte argument
+		"1901",     // uint missing half its 2-byte argument
+		"58",       // byte string missing its length
+		"4301",     // byte string missing 2 of 3 bytes
+		"6261",     // text string missing a byte
+		"8301",     // array missing 2 elements
+		"9f01",     // indefinite array missing its break
+		"5f4101",   // indefinite byte string missing its break
+		"a16161",   // map missing a value
+		"bf616101", // indefinite map missing its break
+		"d8",       // tag missing its number
+		"c2",       // bignum tag missing its content
+		"f9",       // half float missing its bits
+	}
+	for _, h := range truncated {
+		blob, _ := hex.DecodeString(h)
+		var out interface{}
+		err := Loads(blob, &out)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: wanted io.ErrUnexpectedEOF got %v", h, err)
+		}
+	}
+
+	var out interface{}
+	err := Loads([]byte{}, &out)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("empty input: wanted io.EOF got %v", err)
+	}
+}
+
+func TestMaxElements(t *testing.T) {
+	cases := []struct {
+		hex string
+		ok  bool
+	}{
+		{"83010203", true},                      // [1, 2, 3]
+		{"8401020304", false},                   // [1, 2, 3, 4]
+		{"9b0000000100000000", false},           // array declaring 2^32 entries
+		{"82a1616101a1616202", false},           // [{"a": 1}, {"b": 2}] is 4 entries
+		{"9f010203ff", true},                    // [_ 1, 2, 3]
+		{"9f01020304ff", false},                 // [_ 1, 2, 3, 4]
+		{"bf616101616202616303616404ff", false}, // {_ "a": 1, "b": 2, "c": 3, "d": 4}
+	}
+	for _, c := range cases {
+		blob, _ := hex.DecodeString(c.hex)
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.MaxElements = 3
+		var out interface{}
+		err := dec.Decode(&out)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", c.hex, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: wanted error, got %#v", c.hex, out)
+		}
+	}
+
+	// the budget is per item, not per stream
+	blob, _ := hex.DecodeString("8301020383010203")
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.MaxElements = 3
+	var a, b []int
+	err := dec.DecodeSequence(&a, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBytesRead(t *testing.T) {
+	// 1, "abc", [1, 2]
+	blob, _ := hex.DecodeString("016361626382010218")
+	dec := NewDecoder(bytes.NewReader(blob))
+	want := []int64{1, 5, 8}
+	for _, w := range want {
+		var out interface{}
+		err := dec.Decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec.BytesRead() != w {
+			t.Errorf("wanted %d bytes read got %d", w, dec.BytesRead())
+		}
+	}
+
+	// trailing 0x18 is a truncated uint
+	var out interface{}
+	err := dec.Decode(&out)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("wanted io.ErrUnexpectedEOF got %v", err)
+	}
+	if dec.BytesRead() != int64(len(blob)) {
+		t.Errorf("wanted %d bytes read got %d", len(blob), dec.BytesRead())
+	}
+}
+
+func TestTextBytes(t *testing.T) {
+	blob, err := Dumps(TextBytes("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(blob) != "63616263" {
+		t.Errorf("wanted text string got %x", blob)
+	}
+
+	type withText struct {
+		Name TextBytes
+	}
+	blob, err = Dumps(withText{Name: TextBytes("abc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out withText
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Name) != "abc" {
+		t.Errorf("wanted %q got %q", "abc", out.Name)
+	}
+
+	// a byte string still decodes into it
+	var tb TextBytes
+	err = Loads([]byte{0x43, 'a', 'b', 'c'}, &tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tb) != "abc" {
+		t.Errorf("wanted %q got %q", "abc", tb)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	items := []string{
+		"01",                         // 1
+		"3903e7",                     // -1000
+		"4401020304",                 // h'01020304'
+		"5f42010243030405ff",         // (_ h'0102', h'030405')
+		"7f657374726561646d696e67ff", // (_ "strea", "ming")
+		"83010203",                   // [1, 2, 3]
+		"9f018202039f0405ffff",       // [_ 1, [2, 3], [_ 4, 5]]
+		"a26161016162820203",         // {"a": 1, "b": [2, 3]}
+		"bf61610161629f0203ffff",     // {_ "a": 1, "b": [_ 2, 3]}
+		"c249010000000000000000",     // bignum 2^64
+		"f93c00",                     // 1.0 as a half float
+		"fb3ff199999999999a",         // 1.1
+		"f6",                         // null
+	}
+	var all []byte
+	for _, h := range items {
+		blob, _ := hex.DecodeString(h)
+		all = append(all, blob...)
+	}
+	all = append(all, 0x07)
+
+	dec := NewDecoder(bytes.NewReader(all))
+	for _, h := range items {
+		err := dec.Skip()
+		if err != nil {
+			t.Fatalf("%s: %v", h, err)
+		}
+	}
+	var out int
+	err := dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != 7 {
+		t.Errorf("wanted 7 after skipping got %d", out)
+	}
+	if err = dec.Skip(); err != io.EOF {
+		t.Errorf("wanted io.EOF at end got %v", err)
+	}
+
+	dec = NewDecoder(bytes.NewReader([]byte{0x83, 0x01}))
+	if err = dec.Skip(); err != io.ErrUnexpectedEOF {
+		t.Errorf("wanted io.ErrUnexpectedEOF got %v", err)
+	}
+
+	// unknown struct fields are skipped
+	type small struct {
+		A int
+	}
+	blob, _ := hex.DecodeString("a2617883010203616101") // {"x": [1, 2, 3], "a": 1}
+	var s small
+	err = Loads(blob, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.A != 1 {
+		t.Errorf("wanted A=1 got %d", s.A)
+	}
+}
+
+func TestSkipLimits(t *testing.T) {
+	// a length past the end of the input, one too big for an int64, and
+	// one over MaxLen are all errors, not a silent skip of nothing
+	for _, h := range []string{"5a0000000a0102", "5bffffffffffffffff01", "7b8000000000000000"} {
+		blob, _ := hex.DecodeString(h)
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.MaxLen = 100
+		if err := dec.Skip(); err == nil {
+			t.Errorf("%s: expected an error from Skip", h)
+		}
+	}
+
+	dec := NewDecoder(bytes.NewReader([]byte{0x98, 0x65}))
+	dec.MaxLen = 100
+	if err := dec.Skip(); err == nil || !strings.Contains(err.Error(), "MaxLen") {
+		t.Errorf("expected MaxLen error, got %v", err)
+	}
+
+	// Strict applies to skipped items as it does to decoded ones
+	for _, h := range []string{"1805", "9f01ff", "d80500", "5f4101ff"} {
+		blob, _ := hex.DecodeString(h)
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.Strict = true
+		if err := dec.Skip(); err == nil {
+			t.Errorf("%s: expected strict mode error from Skip", h)
+		}
+	}
+}
+
+func TestIndefiniteStringChunks(t *testing.T) {
+	bad := []string{
+		"7f4161ff",         // (_ h'61') in a text string
+		"5f6161ff",         // (_ "a") in a byte string
+		"7f7f6161ffff",     // nested indefinite text string
+		"5f5f4161ffff",     // nested indefinite byte string
+		"7f6161016162ff",   // integer chunk in a text string
+		"5f41618141ff6161", // array chunk in a byte string
+	}
+	for _, h := range bad {
+		blob, _ := hex.DecodeString(h)
+		var out interface{}
+		err := Loads(blob, &out)
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%s: wanted *SyntaxError got %v", h, err)
+		}
+		err = NewDecoder(bytes.NewReader(blob)).Skip()
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%s: Skip wanted *SyntaxError got %v", h, err)
+		}
+	}
+
+	blob, _ := hex.DecodeString("7f6161ff")
+	var out interface{}
+	err := Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "a" {
+		t.Errorf("wanted %q got %#v", "a", out)
+	}
+
+	blob, _ = hex.DecodeString("7f6161616201ff")
+	err = Loads(blob, &out)
+	serr, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("wanted *SyntaxError got %v", err)
+	}
+	if serr.Offset != 6 {
+		t.Errorf("wanted offset 6 got %d", serr.Offset)
+	}
+}
+
+// 200 arrays nested inside each other, each holding a few small items
+func nestedBenchBlob() []byte {
+	var ob interface{} = []interface{}{}
+	for i := 0; i < 200; i++ {
+		ob = []interface{}{uint64(i), "x", true, ob}
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		panic(err)
+	}
+	return blob
+}
+
+func BenchmarkDecodeNested(b *testing.B) {
+	blob := nestedBenchBlob()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(blob)))
+	for i := 0; i < b.N; i++ {
+		var out interface{}
+		err := NewDecoder(bytes.NewReader(blob)).Decode(&out)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// hides the io.ByteReader of a bytes.Reader
+type plainReader struct {
+	r io.Reader
+}
+
+func (pr plainReader) Read(p []byte) (int, error) {
+	return pr.r.Read(p)
+}
+
+func BenchmarkDecodeNestedNoByteReader(b *testing.B) {
+	blob := nestedBenchBlob()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(blob)))
+	for i := 0; i < b.N; i++ {
+		var out interface{}
+		err := NewUnbufferedDecoder(plainReader{bytes.NewReader(blob)}).Decode(&out)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeWithoutByteReader(t *testing.T) {
+	blob := nestedBenchBlob()
+	var a, b interface{}
+	err := NewDecoder(bytes.NewReader(blob)).Decode(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewUnbufferedDecoder(plainReader{bytes.NewReader(blob)})
+	err = dec.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("decoding with and without io.ByteReader differs")
+	}
+	if dec.BytesRead() != int64(len(blob)) {
+		t.Errorf("wanted %d bytes read got %d", len(blob), dec.BytesRead())
+	}
+}
+
+// counts Read calls, like the syscalls of a raw file or socket
+type readCounter struct {
+	r     io.Reader
+	reads int
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	rc.reads++
+	return rc.r.Read(p)
+}
+
+func TestNewDecoderBuffers(t *testing.T) {
+	ob := make([]uint64, 1000)
+	for i := range ob {
+		ob[i] = uint64(i) * 1000
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &readCounter{r: bytes.NewReader(blob)}
+	var out []uint64
+	dec := NewDecoder(rc)
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ob, out) {
+		t.Error("buffered decode differs")
+	}
+	if rc.reads > 10 {
+		t.Errorf("wanted a few buffered reads got %d", rc.reads)
+	}
+	if dec.BytesRead() != int64(len(blob)) {
+		t.Errorf("wanted %d bytes read got %d", len(blob), dec.BytesRead())
+	}
+
+	// an unbuffered decoder leaves the rest of the stream alone
+	r := plainReader{bytes.NewReader(append(blob, 0x01, 0x02))}
+	err = NewUnbufferedDecoder(r).Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, []byte{0x01, 0x02}) {
+		t.Errorf("unbuffered decoder read ahead, left %x", rest)
+	}
+}
+
+func benchmarkDecodeLargeArray(b *testing.B, newDec func(io.Reader) *Decoder) {
+	ob := make([]uint64, 10000)
+	for i := range ob {
+		ob[i] = uint64(i) * 1000
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(blob)))
+	for i := 0; i < b.N; i++ {
+		var out []uint64
+		err = newDec(plainReader{bytes.NewReader(blob)}).Decode(&out)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeLargeArrayUnbuffered(b *testing.B) {
+	benchmarkDecodeLargeArray(b, NewUnbufferedDecoder)
+}
+
+func BenchmarkDecodeLargeArrayBuffered(b *testing.B) {
+	benchmarkDecodeLargeArray(b, NewDecoder)
+}
+
+func TestBufferedEncoder(t *testing.T) {
+	ob := map[string]interface{}{"a": []interface{}{uint64(1), "two", 3.5}, "b": true}
+	want, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewBufferedEncoder(buf)
+	err = enc.Encode(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wanted output held until Flush, got %d bytes", buf.Len())
+	}
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("wanted %x got %x", want, buf.Bytes())
+	}
+
+	// Flush is a no-op for an unbuffered writer
+	err = NewEncoder(&bytes.Buffer{}).Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// counts Write calls, like the syscalls of a raw file or socket
+type writeCounter struct {
+	writes int
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	wc.writes++
+	return len(p), nil
+}
+
+func benchmarkEncodeLargeMap(b *testing.B, newEnc func(io.Writer) *Encoder) {
+	ob := make(map[string]uint64, 1000)
+	for i := 0; i < 1000; i++ {
+		ob[strconv.Itoa(i)] = uint64(i) * 1000
+	}
+	wc := &writeCounter{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		enc := newEnc(wc)
+		err := enc.Encode(ob)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = enc.Flush()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(wc.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkEncodeLargeMapUnbuffered(b *testing.B) {
+	benchmarkEncodeLargeMap(b, NewEncoder)
+}
+
+func BenchmarkEncodeLargeMapBuffered(b *testing.B) {
+	benchmarkEncodeLargeMap(b, NewBufferedEncoder)
+}
+
+func BenchmarkEncodeLargeMapUnsorted(b *testing.B) {
+	benchmarkEncodeLargeMap(b, func(w io.Writer) *Encoder {
+		enc := NewBufferedEncoder(w)
+		enc.SortKeys = false
+		return enc
+	})
+}
+
+type benchPoint struct {
+	X     int
+	Y     int
+	Label string
+}
+
+func BenchmarkDecodeStructSlice(b *testing.B) {
+	ob := make([]benchPoint, 10000)
+	for i := range ob {
+		ob[i] = benchPoint{X: i, Y: -i, Label: "p"}
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(blob)))
+	for i := 0; i < b.N; i++ {
+		var out []benchPoint
+		err = Loads(blob, &out)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeSliceInPlace(t *testing.T) {
+	ob := make([]benchPoint, 100)
+	for i := range ob {
+		ob[i] = benchPoint{X: i, Y: -i, Label: strconv.Itoa(i)}
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []benchPoint
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ob, out) {
+		t.Errorf("wanted %v got %v", ob, out)
+	}
+
+	// indefinite-length arrays grow as they go
+	blob, _ = hex.DecodeString("9f010203040506070809ff")
+	var ints []int
+	err = Loads(blob, &ints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ints, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("got %v", ints)
+	}
+
+	// existing contents are replaced, not merged into, and the
+	// capacity is reused
+	backing := []benchPoint{{X: 1}, {X: 2, Label: "stale"}}
+	out = backing[:1]
+	err = Loads([]byte{0x82, 0xa1, 0x61, 0x59, 0x05, 0xa0}, &out) // [{"Y": 5}, {}]
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []benchPoint{{Y: 5}, {}}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("wanted %v got %v", want, out)
+	}
+	if &out[0] != &backing[0] {
+		t.Error("wanted the slice's capacity reused")
+	}
+}
+
+type quotedStruct struct {
+	ID    int64   `json:"id,string"`
+	Count uint16  `cbor:"count,string"`
+	Ratio float64 `json:"ratio,string"`
+	OK    bool    `json:"ok,string"`
+	Ptr   *int    `json:"ptr,string"`
+	Name  string  `json:"name,string"`
+	Plain int     `json:"plain"`
+}
+
+func TestQuotedFields(t *testing.T) {
+	seven := 7
+	ob := quotedStruct{ID: 1 << 60, Count: 65535, Ratio: 0.1, OK: true, Ptr: &seven, Name: "n", Plain: 3}
+	blob, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic map[string]interface{}
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":    "1152921504606846976",
+		"count": "65535",
+		"ratio": "0.1",
+		"ok":    "true",
+		"ptr":   "7",
+		"name":  "n",
+		"plain": uint64(3),
+	}
+	if !reflect.DeepEqual(generic, want) {
+		t.Errorf("wanted %#v got %#v", want, generic)
+	}
+
+	var out quotedStruct
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ob, out) {
+		t.Errorf("wanted %#v got %#v", ob, out)
+	}
+
+	// out of range for the field
+	blob, _ = Dumps(map[string]string{"count": "65536"})
+	err = Loads(blob, &out)
+	if err == nil {
+		t.Error("wanted error for count out of range")
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	type known struct {
+		Name string `json:"name"`
+	}
+	blob, _ := hex.DecodeString("a2646e616d656161646e616d7a01") // {"name": "a", "namz": 1}
+
+	var out known
+	err := Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields = true
+	err = dec.Decode(&out)
+	if err == nil || !strings.Contains(err.Error(), `"namz"`) {
+		t.Errorf("wanted error naming namz got %v", err)
+	}
+
+	// nested structs are checked too
+	type outer struct {
+		Inner known
+	}
+	blob, _ = hex.DecodeString("a165496e6e6572a1617801") // {"Inner": {"x": 1}}
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields = true
+	var o outer
+	err = dec.Decode(&o)
+	if err == nil {
+		t.Error("wanted error for unknown nested field")
+	}
+
+	// maps take any key
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields = true
+	var m map[string]interface{}
+	err = dec.Decode(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type EmbedBase struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Note string
+}
+
+type EmbedMeta struct {
+	Note    string
+	Version int
+}
+
+type embedDerived struct {
+	EmbedBase
+	*EmbedMeta
+	Name  string `json:"name"` // shadows EmbedBase.Name
+	Extra bool
+}
+
+type embedTagged struct {
+	EmbedBase `json:"base"`
+	Extra     bool
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	ob := embedDerived{
+		EmbedBase: EmbedBase{ID: 1, Name: "hidden", Note: "ambiguous"},
+		EmbedMeta: &EmbedMeta{Note: "ambiguous", Version: 2},
+		Name:      "derived",
+		Extra:     true,
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic map[string]interface{}
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Note is at the same depth in both embedded structs, so neither wins
+	want := map[string]interface{}{
+		"id":      uint64(1),
+		"Version": uint64(2),
+		"name":    "derived",
+		"Extra":   true,
+	}
+	if !reflect.DeepEqual(generic, want) {
+		t.Errorf("wanted %#v got %#v", want, generic)
+	}
+
+	var out embedDerived
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != 1 || out.Name != "derived" || out.EmbedBase.Name != "" || out.EmbedMeta == nil || out.Version != 2 || !out.Extra {
+		t.Errorf("got %#v", out)
+	}
+
+	// a nil embedded pointer leaves its fields out
+	blob, err = Dumps(embedDerived{Name: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic = nil
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := generic["Version"]; ok || len(generic) != 3 {
+		t.Errorf("wanted id, name and Extra only, got %#v", generic)
+	}
+
+	// a tag name keeps the embedded struct as one nested field
+	blob, err = Dumps(embedTagged{EmbedBase: EmbedBase{ID: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic = nil
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := generic["base"].(map[interface{}]interface{}); !ok {
+		t.Errorf("wanted nested base map, got %#v", generic)
+	}
+	var tagged embedTagged
+	err = Loads(blob, &tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged.ID != 3 {
+		t.Errorf("wanted ID 3 got %#v", tagged)
+	}
+}
+
+func TestOnTag(t *testing.T) {
+	// [0("2013-03-21T20:04:00Z"), 2(h'010000000000000000'), 99(24(h'01')), 55799(1)]
+	blob, _ := hex.DecodeString("84c074323031332d30332d32315432303a30343a30305ac249010000000000000000d863d8184101d9d9f701")
+	dec := NewDecoder(bytes.NewReader(blob))
+	var seen []uint64
+	dec.OnTag = func(tag uint64) {
+		seen = append(seen, tag)
+	}
+	dec.TransparentTags[55799] = true
+	var out interface{}
+	err := dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{0, 2, 99, 24, 55799}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("wanted tags %v got %v", want, seen)
+	}
+}
+
+func TestMapRoundTripCanonical(t *testing.T) {
+	// maps from RFC 7049 Appendix A, already in canonical order, and
+	// mixed key types
+	vectors := []string{
+		"a0",
+		"a201020304",
+		"a26161016162820203",
+		"826161a161626163",
+		"a56161614161626142616361436164614461656145",
+		"a3f60120020a03",                 // {null: 1, -1: 2, 10: 3} as {10: 3, -1: 2, null: 1}
+		"a31864016161021901f403",         // {100: 1, "a": 2, 500: 3}
+		"a2f97e0001fb3ff199999999999a02", // {NaN: 1, 1.1: 2}
+	}
+	canonical := map[string]string{
+		"a3f60120020a03":                 "a30a032002f601",
+		"a2f97e0001fb3ff199999999999a02": "a2fb3ff199999999999a02fb7ff800000000000101",
+	}
+	for _, h := range vectors {
+		blob, _ := hex.DecodeString(h)
+		var ob interface{}
+		err := Loads(blob, &ob)
+		if err != nil {
+			t.Fatalf("%s: %v", h, err)
+		}
+		out, err := Dumps(ob)
+		if err != nil {
+			t.Fatalf("%s: %v", h, err)
+		}
+		want := h
+		if c, ok := canonical[h]; ok {
+			want = c
+		}
+		if hex.EncodeToString(out) != want {
+			t.Errorf("%s: wanted %s got %x", h, want, out)
+		}
+	}
+
+	// indefinite-length maps come out definite and sorted
+	blob, _ := hex.DecodeString("bf6346756ef563416d7421ff")
+	var ob interface{}
+	err := Loads(blob, &ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(out) != "a263416d74216346756ef5" {
+		t.Errorf("got %x", out)
+	}
+
+	// keys which encode identically are an error, not a duplicate
+	_, err = Dumps(map[interface{}]interface{}{1: "a", uint64(1): "b"})
+	if err == nil {
+		t.Error("wanted duplicate key error")
+	}
+
+	// an array key can't go in a Go map
+	blob, _ = hex.DecodeString("a182010203")
+	err = Loads(blob, &ob)
+	if err == nil {
+		t.Error("wanted error for array map key")
+	}
+}
+
+func TestUUID(t *testing.T) {
+	u := UUID{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+	if u.String() != "123e4567-e89b-12d3-a456-426614174000" {
+		t.Errorf("got %s", u)
+	}
+	blob, err := Dumps(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(blob) != "d82550123e4567e89b12d3a456426614174000" {
+		t.Errorf("got %x", blob)
+	}
+
+	var generic interface{}
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generic != u {
+		t.Errorf("wanted %v got %#v", u, generic)
+	}
+
+	type record struct {
+		ID  UUID
+		Raw [16]byte
+	}
+	blob, err = Dumps(map[string]interface{}{"ID": u, "Raw": u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r record
+	err = Loads(blob, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != u || r.Raw != [16]byte(u) {
+		t.Errorf("got %#v", r)
+	}
+
+	// wrong length
+	blob, _ = hex.DecodeString("d8254401020304")
+	err = Loads(blob, &generic)
+	if err == nil {
+		t.Error("wanted error for short UUID")
+	}
+}
+
+func TestRejectNonFinite(t *testing.T) {
+	bad := []interface{}{
+		math.NaN(),
+		math.Inf(1),
+		float32(math.Inf(-1)),
+		[]float64{1, math.NaN()},
+		map[string]float32{"x": float32(math.NaN())},
+		Number("NaN"),
+	}
+	for _, ob := range bad {
+		enc := NewEncoder(&bytes.Buffer{})
+		enc.RejectNonFinite = true
+		err := enc.Encode(ob)
+		if err == nil {
+			t.Errorf("%#v: wanted error", ob)
+		}
+		// allowed by default
+		err = NewEncoder(&bytes.Buffer{}).Encode(ob)
+		if err != nil {
+			t.Errorf("%#v: %v", ob, err)
+		}
+	}
+
+	enc := NewEncoder(&bytes.Buffer{})
+	enc.RejectNonFinite = true
+	err := enc.Encode([]float64{0, -1.5, math.MaxFloat64})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHalfFloatVectors(t *testing.T) {
+	// float16 vectors from RFC 7049 Appendix A
+	vectors := []struct {
+		hex  string
+		want float64
+	}{
+		{"f90000", 0.0},
+		{"f98000", math.Copysign(0, -1)},
+		{"f93c00", 1.0},
+		{"f93e00", 1.5},
+		{"f97bff", 65504.0},
+		{"f90001", 5.960464477539063e-8},
+		{"f90400", 0.00006103515625},
+		{"f9c400", -4.0},
+		{"f97c00", math.Inf(1)},
+		{"f97e00", math.NaN()},
+		{"f9fc00", math.Inf(-1)},
+	}
+	for _, v := range vectors {
+		blob, _ := hex.DecodeString(v.hex)
+
+		var f64 float64
+		err := Loads(blob, &f64)
+		if err != nil {
+			t.Fatalf("%s: %v", v.hex, err)
+		}
+		var f32 float32
+		err = Loads(blob, &f32)
+		if err != nil {
+			t.Fatalf("%s: %v", v.hex, err)
+		}
+		var generic interface{}
+		err = Loads(blob, &generic)
+		if err != nil {
+			t.Fatalf("%s: %v", v.hex, err)
+		}
+
+		if math.IsNaN(v.want) {
+			if !math.IsNaN(f64) || !math.IsNaN(float64(f32)) || !math.IsNaN(generic.(float64)) {
+				t.Errorf("%s: wanted NaN got %v %v %v", v.hex, f64, f32, generic)
+			}
+			continue
+		}
+		// every half float is exact as a float32, so compare bits,
+		// which also checks the sign of zero
+		if math.Float64bits(f64) != math.Float64bits(v.want) {
+			t.Errorf("%s: float64 wanted %v got %v", v.hex, v.want, f64)
+		}
+		if math.Float32bits(f32) != math.Float32bits(float32(v.want)) {
+			t.Errorf("%s: float32 wanted %v got %v", v.hex, float32(v.want), f32)
+		}
+		if math.Float64bits(generic.(float64)) != math.Float64bits(v.want) {
+			t.Errorf("%s: interface wanted %v got %v", v.hex, v.want, generic)
+		}
+	}
+
+	// every subnormal half float is exact
+	for mant := uint64(1); mant < 0x400; mant++ {
+		blob := []byte{0xf9, byte(mant >> 8), byte(mant)}
+		var f32 float32
+		err := Loads(blob, &f32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := float32(mant) / (1 << 24); f32 != want {
+			t.Errorf("subnormal %#x: wanted %v got %v", mant, want, f32)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	// 273.15 and values from RFC 7049 section 2.4.3 and beyond 64 bits
+	vectors := []struct {
+		hex string
+		d   Decimal
+		s   string
+	}{
+		{"c48221196ab3", Decimal{Exp: -2, Mantissa: big.NewInt(27315)}, "27315e-2"},
+		{"c482033903e7", Decimal{Exp: 3, Mantissa: big.NewInt(-1000)}, "-1000e3"},
+		{"c48220c249010000000000000000", Decimal{Exp: -1, Mantissa: new(big.Int).Lsh(big.NewInt(1), 64)}, "18446744073709551616e-1"},
+	}
+	for _, v := range vectors {
+		blob, err := Dumps(v.d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(blob) != v.hex {
+			t.Errorf("%s: wanted %s got %x", v.s, v.hex, blob)
+		}
+		if v.d.String() != v.s {
+			t.Errorf("wanted %s got %s", v.s, v.d)
+		}
+
+		var generic interface{}
+		err = Loads(blob, &generic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, ok := generic.(Decimal)
+		if !ok || d.Exp != v.d.Exp || d.Mantissa.Cmp(v.d.Mantissa) != 0 {
+			t.Errorf("%s: got %#v", v.hex, generic)
+		}
+
+		// the parts arrive as Numbers with UseNumber
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.UseNumber = true
+		generic = nil
+		err = dec.Decode(&generic)
+		d, ok = generic.(Decimal)
+		if err != nil || !ok || d.Exp != v.d.Exp || d.Mantissa.Cmp(v.d.Mantissa) != 0 {
+			t.Errorf("%s: UseNumber got %#v %v", v.hex, generic, err)
+		}
+
+		var typed Decimal
+		err = Loads(blob, &typed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Dumps(typed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, blob) {
+			t.Errorf("%s: round trip gave %x", v.hex, again)
+		}
+	}
+
+	// the tag's content is consumed, so what follows still decodes
+	blob, _ := hex.DecodeString("82c48221196ab307")
+	var arr []interface{}
+	err := Loads(blob, &arr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arr) != 2 || arr[1] != uint64(7) {
+		t.Errorf("got %#v", arr)
+	}
+
+	blob, _ = hex.DecodeString("c483010203")
+	var generic interface{}
+	if err = Loads(blob, &generic); err == nil {
+		t.Error("wanted error for three item decimal")
+	}
+	blob, _ = hex.DecodeString("c482f93c0001")
+	if err = Loads(blob, &generic); err == nil {
+		t.Error("wanted error for float exponent")
+	}
+}
+
+func TestDecodeTwiceIntoSameTarget(t *testing.T) {
+	first, _ := Dumps([]int{1, 2, 3})
+	second, _ := Dumps([]int{4})
+	var ints []int
+	for _, blob := range [][]byte{first, second} {
+		err := Loads(blob, &ints)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(ints, []int{4}) {
+		t.Errorf("wanted [4] got %v", ints)
+	}
+
+	first, _ = Dumps(map[string]int{"a": 1, "b": 2})
+	second, _ = Dumps(map[string]int{"c": 3})
+	var m map[string]int
+	for _, blob := range [][]byte{first, second} {
+		err := Loads(blob, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(m, map[string]int{"c": 3}) {
+		t.Errorf("wanted map[c:3] got %v", m)
+	}
+}
+
+func TestCaseSensitiveFields(t *testing.T) {
+	type user struct {
+		UserID int
+		Name   string `json:"name"`
+		NAME   string `json:"NAME"`
+	}
+	// {"userid": 1, "NAME": "upper", "name": "lower"}
+	blob, _ := hex.DecodeString("a36675736572696401644e414d45657570706572646e616d65656c6f776572")
+
+	// by default case is ignored, but an exact match is preferred
+	var u user
+	err := Loads(blob, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UserID != 1 || u.Name != "lower" || u.NAME != "upper" {
+		t.Errorf("got %#v", u)
+	}
+
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.CaseSensitiveFields = true
+	u = user{}
+	err = dec.Decode(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UserID != 0 || u.Name != "lower" || u.NAME != "upper" {
+		t.Errorf("got %#v", u)
+	}
+}
+
+func TestDecodeArrayIter(t *testing.T) {
+	type rec struct {
+		A int
+		B string
+	}
+	recs := []rec{{1, "one"}, {2, ""}, {3, "three"}}
+	definite, _ := Dumps(recs)
+	// the same as an indefinite-length array
+	indefinite := append([]byte{0x9f}, definite[1:]...)
+	indefinite = append(indefinite, 0xff)
+
+	for _, blob := range [][]byte{definite, indefinite} {
+		// followed by another item
+		dec := NewDecoder(bytes.NewReader(append(blob, 0x07)))
+		var r rec
+		next, err := dec.DecodeArrayIter(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []rec
+		ok, err := next()
+		for ; ok; ok, err = next() {
+			got = append(got, r)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, recs) {
+			t.Errorf("wanted %v got %v", recs, got)
+		}
+		if ok, err = next(); ok || err != nil {
+			t.Errorf("exhausted iterator returned %v %v", ok, err)
+		}
+		var after int
+		err = dec.Decode(&after)
+		if err != nil || after != 7 {
+			t.Errorf("wanted 7 after the array got %d %v", after, err)
+		}
+	}
+
+	var x int
+	_, err := NewDecoder(bytes.NewReader([]byte{0xa0})).DecodeArrayIter(&x)
+	if err == nil {
+		t.Error("wanted error for a map")
+	}
+
+	// truncated after the first element
+	next, err := NewDecoder(bytes.NewReader([]byte{0x83, 0x01})).DecodeArrayIter(&x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := next(); !ok || err != nil || x != 1 {
+		t.Errorf("got %v %v %d", ok, err, x)
+	}
+	if _, err := next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("wanted io.ErrUnexpectedEOF got %v", err)
+	}
+}
+
+func TestMinimalIntegerEncoding(t *testing.T) {
+	vectors := []struct {
+		x   uint64
+		hex string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{255, "18ff"},
+		{256, "190100"},
+		{65535, "19ffff"},
+		{65536, "1a00010000"},
+		{4294967295, "1affffffff"},
+		{4294967296, "1b0000000100000000"},
+		{18446744073709551615, "1bffffffffffffffff"},
+	}
+	for _, v := range vectors {
+		blob, err := Dumps(v.x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(blob) != v.hex {
+			t.Errorf("%d: wanted %s got %x", v.x, v.hex, blob)
+		}
+		if enc := hex.EncodeToString(EncodeInt(MajorTypeUint, v.x, nil)); enc != v.hex {
+			t.Errorf("EncodeInt %d: wanted %s got %s", v.x, v.hex, enc)
+		}
+		// negative integers use the same widths
+		if v.x <= math.MaxInt64 {
+			want, _ := hex.DecodeString(v.hex)
+			want[0] |= 0x20
+			blob, _ = Dumps(-1 - int64(v.x))
+			if !bytes.Equal(blob, want) {
+				t.Errorf("-1-%d: wanted %x got %x", v.x, want, blob)
+			}
+		}
+	}
+
+	// and lengths
+	blob, _ := Dumps(make([]byte, 255))
+	if hex.EncodeToString(blob[:2]) != "58ff" || len(blob) != 257 {
+		t.Errorf("255 byte string header %x", blob[:3])
+	}
+}
+
+// populated only through its setter, from a [name, age] pair
+type setterPerson struct {
+	name string
+	age  int
+}
+
+func (p *setterPerson) FromCBOR(v interface{}) error {
+	pair, ok := v.([]interface{})
+	if !ok || len(pair) != 2 {
+		return fmt.Errorf("want [name, age], got %#v", v)
+	}
+	name, _ := pair[0].(string)
+	age, _ := pair[1].(uint64)
+	p.name = name
+	p.age = int(age)
+	return nil
+}
+
+func TestUnmarshallValue(t *testing.T) {
+	blob, _ := hex.DecodeString("82636269631825") // ["bic", 37]
+	var p setterPerson
+	err := Loads(blob, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.name != "bic" || p.age != 37 {
+		t.Errorf("got %#v", p)
+	}
+
+	type team struct {
+		Lead    setterPerson
+		Deputy  *setterPerson
+		Absent  *setterPerson
+		Members map[string]setterPerson
+		List    []setterPerson
+	}
+	ob := map[string]interface{}{
+		"Lead":    []interface{}{"ann", 40},
+		"Deputy":  []interface{}{"bob", 30},
+		"Absent":  nil,
+		"Members": map[string]interface{}{"c": []interface{}{"cat", 20}},
+		"List":    []interface{}{[]interface{}{"dan", 10}},
+	}
+	blob, err = Dumps(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tm team
+	err = Loads(blob, &tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.Lead.name != "ann" || tm.Deputy == nil || tm.Deputy.age != 30 || tm.Absent != nil ||
+		tm.Members["c"].name != "cat" || len(tm.List) != 1 || tm.List[0].age != 10 {
+		t.Errorf("got %#v", tm)
+	}
+
+	// errors from FromCBOR are returned
+	blob, _ = Dumps(map[string]interface{}{"Lead": "nobody"})
+	err = Loads(blob, &tm)
+	if err == nil {
+		t.Error("wanted error from FromCBOR")
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	om := OrderedMap{
+		{Key: "zebra", Value: 1},
+		{Key: "apple", Value: []interface{}{"x"}},
+		{Key: 10, Value: nil},
+	}
+	blob, err := Dumps(om)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"zebra": 1, "apple": ["x"], 10: null}, unsorted
+	want := "a3657a6562726101656170706c658161780af6"
+	if hex.EncodeToString(blob) != want {
+		t.Errorf("wanted %s got %x", want, blob)
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.IndefiniteCollections = true
+	err = enc.Encode(om)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "bf657a6562726101656170706c659f6178ff0af6ff"
+	if hex.EncodeToString(buf.Bytes()) != want {
+		t.Errorf("indefinite: wanted %s got %x", want, buf.Bytes())
+	}
+
+	var out OrderedMap
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOut := OrderedMap{
+		{Key: "zebra", Value: uint64(1)},
+		{Key: "apple", Value: []interface{}{"x"}},
+		{Key: uint64(10), Value: nil},
+	}
+	if !reflect.DeepEqual(out, wantOut) {
+		t.Errorf("wanted %#v got %#v", wantOut, out)
+	}
+
+	// keys Go maps can't hold, and reuse replaces the contents
+	blob, _ = hex.DecodeString("a182010203") // {[1, 2]: 3}
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || !reflect.DeepEqual(out[0].Key, []interface{}{uint64(1), uint64(2)}) {
+		t.Errorf("got %#v", out)
+	}
+
+	// as a struct field
+	type doc struct {
+		Meta OrderedMap
+	}
+	blob, _ = Dumps(map[string]interface{}{"Meta": om})
+	var d doc
+	err = Loads(blob, &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Meta) != 3 || d.Meta[0].Key != "zebra" {
+		t.Errorf("got %#v", d)
+	}
+}
+
+func TestDecodeReflect(t *testing.T) {
+	type pair struct {
+		A int
+		B []string
+	}
+	blob, _ := Dumps(pair{A: 1, B: []string{"x"}})
+
+	var p pair
+	// a settable value
+	err := NewDecoder(bytes.NewReader(blob)).DecodeReflect(reflect.ValueOf(&p).Elem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.A != 1 || len(p.B) != 1 {
+		t.Errorf("got %#v", p)
+	}
+
+	// a field, and a pointer
+	blob, _ = Dumps(7)
+	err = NewDecoder(bytes.NewReader(blob)).DecodeReflect(reflect.ValueOf(&p).Elem().Field(0))
+	if err != nil || p.A != 7 {
+		t.Errorf("got %d %v", p.A, err)
+	}
+	var x int
+	err = NewDecoder(bytes.NewReader(blob)).DecodeReflect(reflect.ValueOf(&x))
+	if err != nil || x != 7 {
+		t.Errorf("got %d %v", x, err)
+	}
+
+	bad := []reflect.Value{
+		{},
+		reflect.ValueOf(p),
+		reflect.ValueOf((*int)(nil)),
+	}
+	for _, rv := range bad {
+		err = NewDecoder(bytes.NewReader(blob)).DecodeReflect(rv)
+		if _, ok := err.(*InvalidUnmarshalError); !ok {
+			t.Errorf("%v: wanted InvalidUnmarshalError got %v", rv, err)
+		}
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	type opts struct {
+		Flag    *bool             `json:"flag,omitempty"`
+		Count   int               `json:"count,omitempty"`
+		Name    string            `cbor:"name,omitempty"`
+		Tags    []string          `json:"tags,omitempty"`
+		Attrs   map[string]string `json:"attrs,omitempty"`
+		Any     interface{}       `json:",omitempty"`
+		Always  int               `json:"always"`
+		Zero    struct{}          `json:"zero,omitempty"`
+		Ignored int               `json:"ignored,omitempty" cbor:"ignored"`
+	}
+
+	no := false
+	blob, err := Dumps(opts{Flag: &no})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic map[string]interface{}
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a non-nil pointer to false is kept, structs are never empty, and
+	// the cbor tag's options replace the json tag's
+	want := map[string]interface{}{
+		"flag":    false,
+		"always":  uint64(0),
+		"zero":    map[interface{}]interface{}{},
+		"ignored": uint64(0),
+	}
+	if !reflect.DeepEqual(generic, want) {
+		t.Errorf("wanted %#v got %#v", want, generic)
+	}
+
+	blob, err = Dumps(opts{Count: 2, Name: "n", Tags: []string{"a"}, Any: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic = nil
+	err = Loads(blob, &generic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"count", "name", "tags", "Any"} {
+		if _, ok := generic[k]; !ok {
+			t.Errorf("wanted %s present in %#v", k, generic)
+		}
+	}
+	if _, ok := generic["flag"]; ok {
+		t.Error("wanted nil flag omitted")
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	seeds := []string{
+		"00", "3903e7", "4401020304", "5f42010243030405ff", "7f657374726561646d696e67ff",
+		"83010203", "9f018202039f0405ffff", "a26161016162820203", "bf61610161629f0203ffff",
+		"c249010000000000000000", "c48221196ab3", "d82550123e4567e89b12d3a456426614174000",
+		"f93c00", "fb3ff199999999999a", "f6", "f7", "a182010203",
+	}
+	for _, h := range seeds {
+		blob, _ := hex.DecodeString(h)
+		f.Add(blob)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.MaxElements = 1 << 16
+		var out interface{}
+		err := dec.Decode(&out)
+		if err != nil {
+			return
+		}
+		// whatever decodes must encode again
+		_, err = Dumps(out)
+		if err != nil {
+			t.Errorf("%x decoded to %#v which doesn't encode: %v", data, out, err)
+		}
+	})
+}
+
+func TestDecodeFuzzRegressions(t *testing.T) {
+	var out interface{}
+	// additional info 28 is reserved
+	blob, _ := hex.DecodeString("1c")
+	err := Loads(blob, &out)
+	if err == nil {
+		t.Error("expected error for reserved additional info")
+	}
+
+	var arr [2]int
+	blob, _ = hex.DecodeString("83010203")
+	err = Loads(blob, &arr)
+	if err == nil {
+		t.Error("expected error decoding three elements into [2]int")
+	}
+	blob, _ = hex.DecodeString("9f010203ff")
+	err = Loads(blob, &arr)
+	if err == nil {
+		t.Error("expected error decoding indefinite array into [2]int")
+	}
+}
+
+func TestDecodeIntoNilPointerFields(t *testing.T) {
+	type Inner struct {
+		A int
+	}
+	type Outer struct {
+		In   *Inner
+		List *[]int
+	}
+	blob, _ := hex.DecodeString("a262496ea1614107644c697374820102")
+	var out Outer
+	err := Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.In == nil || out.In.A != 7 {
+		t.Errorf("bad inner %#v", out.In)
+	}
+	if out.List == nil || !reflect.DeepEqual(*out.List, []int{1, 2}) {
+		t.Errorf("bad list %#v", out.List)
+	}
+}
+
+func TestDecodeMaxLen(t *testing.T) {
+	cases := []string{
+		"83010203",       // array
+		"a3010102020303", // map
+		"43010203",       // bytes
+		"63616263",       // text
+	}
+	for _, h := range cases {
+		blob, _ := hex.DecodeString(h)
+		var out interface{}
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.MaxLen = 2
+		err := dec.Decode(&out)
+		if err == nil {
+			t.Errorf("%s: expected MaxLen error", h)
+		}
+		dec = NewDecoder(bytes.NewReader(blob))
+		dec.MaxLen = 3
+		err = dec.Decode(&out)
+		if err != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+
+	// a length beyond int is rejected rather than truncated
+	blob, _ := hex.DecodeString("9bffffffffffffffff")
+	var out []int
+	err := Loads(blob, &out)
+	if err == nil {
+		t.Error("expected overflow error for huge array length")
+	}
+}
+
+func TestDecodeIPFromBytes(t *testing.T) {
+	type Host struct {
+		IP   net.IP
+		Addr netip.Addr
+		Ptr  *netip.Addr
+	}
+	v4 := []byte{192, 0, 2, 1}
+	v6 := net.ParseIP("2001:db8::1").To16()
+	blob, err := Dumps(map[string]interface{}{"IP": v4, "Addr": []byte(v6), "Ptr": v4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Host
+	err = Loads(blob, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("bad net.IP %v", h.IP)
+	}
+	if h.Addr != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("bad netip.Addr %v", h.Addr)
+	}
+	if h.Ptr == nil || *h.Ptr != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("bad *netip.Addr %v", h.Ptr)
+	}
+
+	// text forms still go through UnmarshalText
+	blob, _ = Dumps(map[string]interface{}{"Addr": "192.0.2.1"})
+	h = Host{}
+	err = Loads(blob, &h)
+	if err != nil || h.Addr != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("text addr: %v %v", h.Addr, err)
+	}
+
+	blob, _ = Dumps(map[string]interface{}{"IP": []byte{1, 2, 3}})
+	err = Loads(blob, &h)
+	if err == nil {
+		t.Error("expected error for 3 byte IP")
+	}
+}
+
+// keeps the encoding of whatever tag 99 wraps
+type rawSigDecoder struct{}
+
+func (rawSigDecoder) GetTag() uint64 { return 99 }
+
+func (rawSigDecoder) DecodeTarget() interface{} { panic("DecodeTarget called on a RawTagDecoder") }
+
+func (rawSigDecoder) PostDecode(interface{}) (interface{}, error) {
+	panic("PostDecode called on a RawTagDecoder")
+}
+
+func (rawSigDecoder) DecodeRaw(raw []byte) (interface{}, error) {
+	return hex.EncodeToString(raw), nil
+}
+
+func TestRawTagDecoder(t *testing.T) {
+	// [99([1, {"a": h'0102'}]), 7]
+	blob, _ := hex.DecodeString("82d8638201a1616142010207")
+	var out []interface{}
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.TagDecoders[99] = rawSigDecoder{}
+	err := dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"8201a16161420102", uint64(7)}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %#v, wanted %#v", out, expected)
+	}
+
+	var s string
+	dec = NewDecoder(bytes.NewReader(blob[1:]))
+	dec.TagDecoders[99] = rawSigDecoder{}
+	err = dec.Decode(&s)
+	if err != nil || s != "8201a16161420102" {
+		t.Errorf("got %q %v", s, err)
+	}
+}
+
+func TestComplexRoundTrip(t *testing.T) {
+	type Sample struct {
+		C64  complex64
+		C128 complex128
+	}
+	in := Sample{C64: complex(1.5, -2), C128: complex(0.1, 1e300)}
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Sample
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("got %#v, wanted %#v", out, in)
+	}
+
+	// complex64 parts are written as float32
+	blob, _ = Dumps(complex64(complex(1, 2)))
+	expected, _ := hex.DecodeString("82fa3f800000fa40000000")
+	if !bytes.Equal(blob, expected) {
+		t.Errorf("got %x, wanted %x", blob, expected)
+	}
+
+	var c complex128
+	blob, _ = hex.DecodeString("83010203")
+	if err := Loads(blob, &c); err == nil {
+		t.Error("expected error decoding 3 elements into complex128")
+	}
+	blob, _ = hex.DecodeString("8101")
+	if err := Loads(blob, &c); err == nil {
+		t.Error("expected error decoding 1 element into complex128")
+	}
+}
+
+func TestEncodeUnsortedKeys(t *testing.T) {
+	ob := map[string]int{}
+	for i := 0; i < 50; i++ {
+		ob[strconv.Itoa(i)] = i
+	}
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.SortKeys = false
+	err := enc.Encode(ob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]int
+	err = Loads(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, ob) {
+		t.Errorf("got %v, wanted %v", out, ob)
+	}
+	sorted, _ := Dumps(ob)
+	if len(sorted) != buf.Len() {
+		t.Errorf("unsorted encoding is %d bytes, sorted %d", buf.Len(), len(sorted))
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	type Counts struct {
+		N int
+	}
+	// {"N": true}
+	blob, _ := hex.DecodeString("a1614ef5")
+	var c Counts
+	err := Loads(blob, &c)
+	te, ok := err.(*UnmarshalTypeError)
+	if !ok {
+		t.Fatalf("expected *UnmarshalTypeError, got %T %v", err, err)
+	}
+	if te.Value != "bool" || te.Type != reflect.TypeOf(0) || te.Offset != 4 {
+		t.Errorf("bad error %#v", te)
+	}
+
+	var f float64
+	blob, _ = hex.DecodeString("6161")
+	err = Loads(blob, &f)
+	if _, ok := err.(*UnmarshalTypeError); !ok {
+		t.Errorf("expected *UnmarshalTypeError for string into float64, got %v", err)
+	}
+}
+
+func TestDecodeRunesAndByteArrays(t *testing.T) {
+	type Entry struct {
+		Key  []rune
+		Hash [4]byte
+	}
+	blob, err := Dumps(map[string]interface{}{"Key": "héllo", "Hash": []byte{1, 2, 3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	err = Loads(blob, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Key) != "héllo" || e.Hash != [4]byte{1, 2, 3, 4} {
+		t.Errorf("bad decode %#v", e)
+	}
+
+	var short [4]byte
+	blob, _ = hex.DecodeString("43010203")
+	if err := Loads(blob, &short); err == nil {
+		t.Error("expected error decoding 3 bytes into [4]byte")
+	}
+	var ints []int
+	blob, _ = hex.DecodeString("6161")
+	if err := Loads(blob, &ints); err == nil {
+		t.Error("expected error decoding a string into []int")
+	}
+}
+
+func TestSplitInitialByte(t *testing.T) {
+	cases := []struct {
+		b     byte
+		major byte
+		info  byte
+	}{
+		{0x17, MajorTypeUint, 23},
+		{0x38, MajorTypeNegInt, InfoUint8Follows},
+		{0x5f, MajorTypeBytes, InfoIndefinite},
+		{0xd9, MajorTypeTag, InfoUint16Follows},
+		{0xfb, MajorTypeFloat, InfoUint64Follows},
+		{0xf6, MajorTypeSimple, SimpleValueNull},
+	}
+	for _, c := range cases {
+		major, info := SplitInitialByte(c.b)
+		if major != c.major || info != c.info {
+			t.Errorf("%02x: got %d/%d, wanted %d/%d", c.b, major, info, c.major, c.info)
+		}
+	}
+}
+
+func TestPeekType(t *testing.T) {
+	// "a", {"b": 1}, 7
+	blob, _ := hex.DecodeString("6161a161620107")
+	dec := NewDecoder(bytes.NewReader(blob))
+	expected := []byte{MajorTypeText, MajorTypeMap, MajorTypeUint}
+	for i, want := range expected {
+		mt, err := dec.PeekType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// peeking again doesn't move on
+		mt2, _ := dec.PeekType()
+		if mt != want || mt2 != want {
+			t.Fatalf("item %d: got major type %d/%d, wanted %d", i, mt, mt2, want)
+		}
+		var out interface{}
+		switch mt {
+		case MajorTypeText:
+			var s string
+			err = dec.Decode(&s)
+			out = s
+		case MajorTypeMap:
+			var m map[string]int
+			err = dec.Decode(&m)
+			out = m
+		default:
+			err = dec.Skip()
+		}
+		if err != nil {
+			t.Fatalf("item %d: %v (%v)", i, err, out)
+		}
+	}
+	_, err := dec.PeekType()
+	if err != io.EOF {
+		t.Errorf("expected io.EOF at the end, got %v", err)
+	}
+}
+
+func TestRawMessageField(t *testing.T) {
+	type Envelope struct {
+		Type    string
+		Payload RawMessage
+		Extra   *RawMessage
+	}
+	type Point struct {
+		X, Y int
+	}
+	payload, _ := Dumps(Point{X: 1, Y: -2})
+	blob, err := Dumps(map[string]interface{}{
+		"Type":    "point",
+		"Payload": RawMessage(payload),
+		"Extra":   []interface{}{"a", 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env Envelope
+	err = Loads(blob, &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != "point" || !bytes.Equal(env.Payload, payload) {
+		t.Fatalf("bad envelope %#v, wanted payload %x", env, payload)
+	}
+	if env.Extra == nil || hex.EncodeToString(*env.Extra) != "82616109" {
+		t.Errorf("bad extra %#v", env.Extra)
+	}
+	var p Point
+	err = Loads(env.Payload, &p)
+	if err != nil || p != (Point{X: 1, Y: -2}) {
+		t.Errorf("payload decoded to %#v %v", p, err)
+	}
+
+	// indefinite-length items are kept as they were sent
+	var raw RawMessage
+	in, _ := hex.DecodeString("9f0102ff")
+	err = Loads(in, &raw)
+	if err != nil || !bytes.Equal(raw, in) {
+		t.Errorf("got %x %v", raw, err)
+	}
+	out, _ := Dumps(raw)
+	if !bytes.Equal(out, in) {
+		t.Errorf("re-encoded as %x", out)
+	}
+	out, _ = Dumps(RawMessage(nil))
+	if hex.EncodeToString(out) != "f6" {
+		t.Errorf("nil RawMessage encoded as %x", out)
+	}
+}
+
+func TestRawMessageLimits(t *testing.T) {
+	longBytes := append([]byte{0x59, 0x03, 0xe8}, make([]byte, 1000)...)
+	dec := NewDecoder(bytes.NewReader(longBytes))
+	dec.MaxLen = 10
+	var raw RawMessage
+	if err := dec.Decode(&raw); err == nil || !strings.Contains(err.Error(), "MaxLen") {
+		t.Errorf("expected MaxLen error, got %v", err)
+	}
+
+	arr := []byte{0x99, 0x03, 0xe8}
+	for i := 0; i < 1000; i++ {
+		arr = append(arr, 0x01)
+	}
+	for _, blob := range [][]byte{arr, append(append([]byte{0x9f}, arr[3:]...), 0xff)} {
+		dec = NewDecoder(bytes.NewReader(blob))
+		dec.MaxElements = 10
+		if err := dec.Decode(&raw); err == nil || !strings.Contains(err.Error(), "collection elements") {
+			t.Errorf("expected MaxElements error, got %v", err)
+		}
+	}
+
+	// a length running past the end of the input
+	blob, _ := hex.DecodeString("5bffffffffffffffff")
+	if err := Loads(blob, &raw); err == nil {
+		t.Errorf("expected an error, captured %x", raw)
+	}
+
+	dec = NewDecoder(bytes.NewReader([]byte{0x18, 0x05}))
+	dec.Strict = true
+	if err := dec.Decode(&raw); err == nil {
+		t.Errorf("expected strict mode error, captured %x", raw)
+	}
+}
+
+func TestEncodeBigIntFields(t *testing.T) {
+	type Account struct {
+		Balance *big.Int
+		Limit   big.Int
+		Missing *big.Int
+		History []*big.Int
+	}
+	huge, _ := new(big.Int).SetString("18446744073709551616", 10)
+	in := Account{
+		Balance: huge,
+		History: []*big.Int{big.NewInt(-5), new(big.Int).Neg(huge)},
+	}
+	in.Limit.SetInt64(1000)
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tag 2 bignum for 2^64, a plain int for the limit
+	if !bytes.Contains(blob, []byte{0xc2, 0x49, 1, 0, 0, 0, 0, 0, 0, 0, 0}) || !bytes.Contains(blob, []byte{0x19, 0x03, 0xe8}) {
+		t.Errorf("unexpected encoding %x", blob)
+	}
+	var out Account
+	err = Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Balance.Cmp(huge) != 0 || out.Limit.Int64() != 1000 || out.Missing != nil {
+		t.Errorf("bad decode %v %v %v", out.Balance, &out.Limit, out.Missing)
+	}
+	if len(out.History) != 2 || out.History[0].Int64() != -5 || out.History[1].Cmp(new(big.Int).Neg(huge)) != 0 {
+		t.Errorf("bad history %v", out.History)
+	}
+}
+
+func TestDecodeUnsupportedSimple(t *testing.T) {
+	for _, h := range []string{"f818", "f8ff", "e0", "f3"} {
+		blob, _ := hex.DecodeString(h)
+		var out interface{}
+		err := Loads(blob, &out)
+		if !errors.Is(err, ErrUnsupportedType) {
+			t.Errorf("%s: expected ErrUnsupportedType, got %v", h, err)
+		}
+	}
+
+	// undefined decodes as null
+	out := interface{}(5)
+	blob, _ := hex.DecodeString("f7")
+	err := Loads(blob, &out)
+	if err != nil || out != nil {
+		t.Errorf("undefined gave %v %v", out, err)
+	}
+}
+
+func TestDurationModes(t *testing.T) {
+	type Job struct {
+		Timeout time.Duration
+		Retry   *time.Duration
+	}
+	retry := 1500 * time.Millisecond
+	in := Job{Timeout: 90 * time.Minute, Retry: &retry}
+
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Job
+	err = Loads(blob, &out)
+	if err != nil || out.Timeout != in.Timeout || *out.Retry != retry {
+		t.Errorf("nanoseconds: got %#v %v", out, err)
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.DurationMode = DurationString
+	err = enc.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("1h30m0s")) || !bytes.Contains(buf.Bytes(), []byte("1.5s")) {
+		t.Errorf("durations not written as text: %x", buf.Bytes())
+	}
+	out = Job{}
+	err = Loads(buf.Bytes(), &out)
+	if err != nil || out.Timeout != in.Timeout || *out.Retry != retry {
+		t.Errorf("string: got %#v %v", out, err)
+	}
+}
+
+func TestSortKeysKeepsOptions(t *testing.T) {
+	type key struct {
+		D time.Duration
+	}
+	in := map[key]int{{D: time.Second}: 1}
+	var outs []string
+	for _, sorted := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf)
+		enc.DurationMode = DurationString
+		enc.SortKeys = sorted
+		err := enc.Encode(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, hex.EncodeToString(buf.Bytes()))
+	}
+	// {{"D": "1s"}: 1}
+	if outs[0] != "a1a1614462317301" || outs[1] != outs[0] {
+		t.Errorf("unsorted %s, sorted %s", outs[0], outs[1])
+	}
+}
+
+func TestDecodeBignumLimits(t *testing.T) {
+	var out big.Int
+	// 2("abc")
+	blob, _ := hex.DecodeString("c263616263")
+	err := Loads(blob, &out)
+	if te, ok := err.(*TagContentError); !ok || te.Tag != 2 {
+		t.Errorf("expected TagContentError for tag 2, got %v", err)
+	}
+
+	// a bignum claiming 2^32 bytes fails on MaxLen before reading
+	blob, _ = hex.DecodeString("c35b0000000100000000")
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.MaxLen = 1 << 16
+	err = dec.Decode(&out)
+	if err == nil || !strings.Contains(err.Error(), "MaxLen") {
+		t.Errorf("expected MaxLen error, got %v", err)
+	}
+
+	// indefinite-length content is joined
+	blob, _ = hex.DecodeString("c25f4101420000ff")
+	err = Loads(blob, &out)
+	if err != nil || out.Cmp(big.NewInt(0x10000)) != 0 {
+		t.Errorf("got %v %v", &out, err)
+	}
+	blob, _ = hex.DecodeString("c25f410141004100ff")
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.MaxLen = 2
+	err = dec.Decode(&out)
+	if err == nil {
+		t.Error("expected MaxLen error for 3 bytes of chunks")
+	}
+}
+
+func TestIntDecodeMode(t *testing.T) {
+	// [5, -3, 18446744073709551615, {1: 2}]
+	blob, _ := hex.DecodeString("8405221bffffffffffffffffa10102")
+	var out interface{}
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.IntDecodeMode = IntDecodeInt64
+	err := dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		int64(5), int64(-3), uint64(math.MaxUint64),
+		map[interface{}]interface{}{int64(1): int64(2)},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %#v, wanted %#v", out, expected)
+	}
+
+	out = nil
+	err = Loads(blob, &out)
+	if err != nil || out.([]interface{})[0] != uint64(5) {
+		t.Errorf("default mode gave %#v %v", out, err)
+	}
+}
+
+func TestEncodeIndefiniteCollections(t *testing.T) {
+	in := map[string][]int{"a": {1, 2}, "b": {}}
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.IndefiniteCollections = true
+	err := enc.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "bf61619f0102ff61629fffff"
+	if hex.EncodeToString(buf.Bytes()) != expected {
+		t.Errorf("got %x, wanted %s", buf.Bytes(), expected)
+	}
+	var out map[string][]int
+	err = Loads(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || !reflect.DeepEqual(out["a"], []int{1, 2}) || len(out["b"]) != 0 {
+		t.Errorf("got %#v", out)
+	}
+
+	enc = NewEncoder(new(bytes.Buffer))
+	enc.IndefiniteCollections = true
+	enc.StructKeyOrder = CanonicalOrder
+	if err := enc.Encode([]int{1}); err == nil {
+		t.Error("expected error combining IndefiniteCollections with CanonicalOrder")
+	}
+}
+
+func TestDecodeNullSemantics(t *testing.T) {
+	type Target struct {
+		P *int
+		I interface{}
+		S []int
+		M map[string]int
+		T string
+		A [2]int
+		N int
+		B bool
+	}
+	seven := 7
+	tg := Target{P: &seven, I: "x", S: []int{1}, M: map[string]int{"a": 1}, T: "t", A: [2]int{1, 2}}
+	// {"P": null, "I": null, "S": null, "M": null, "T": null, "A": null}
+	blob, _ := hex.DecodeString("a66150f66149f66153f6614df66154f66141f6")
+	err := Loads(blob, &tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tg, Target{}) {
+		t.Errorf("null didn't clear everything: %#v", tg)
+	}
+
+	for _, h := range []string{"a1614ef6", "a16142f6"} {
+		blob, _ = hex.DecodeString(h)
+		err = Loads(blob, &tg)
+		if te, ok := err.(*UnmarshalTypeError); !ok || te.Value != "null" {
+			t.Errorf("%s: expected null UnmarshalTypeError, got %v", h, err)
+		}
+	}
+}
+
+func TestWriteSimple(t *testing.T) {
+	for v := 0; v < 256; v++ {
+		buf := new(bytes.Buffer)
+		enc := NewEncoder(buf)
+		err := enc.writeSimple(uint8(v))
+		switch {
+		case v < 24:
+			if err != nil || !bytes.Equal(buf.Bytes(), []byte{0xe0 | byte(v)}) {
+				t.Errorf("%d: got %x %v", v, buf.Bytes(), err)
+			}
+		case v < 32:
+			if err == nil {
+				t.Errorf("%d: expected error for reserved simple value", v)
+			}
+		default:
+			if err != nil || !bytes.Equal(buf.Bytes(), []byte{0xf8, byte(v)}) {
+				t.Errorf("%d: got %x %v", v, buf.Bytes(), err)
+			}
+		}
+	}
+
+	blob, _ := Dumps([]interface{}{true, false, nil})
+	if hex.EncodeToString(blob) != "83f5f4f6" {
+		t.Errorf("got %x", blob)
+	}
+	buf := new(bytes.Buffer)
+	NewEncoder(buf).writeSimple(SimpleValueUndefined)
+	if hex.EncodeToString(buf.Bytes()) != "f7" {
+		t.Errorf("undefined written as %x", buf.Bytes())
+	}
+}
+
+type Color string
+
+const (
+	Red   Color = "red"
+	Green Color = "green"
+)
+
+type Level uint8
+
+type Celsius float32
+
+type MyBool bool
+
+func TestDecodeNamedScalarTypes(t *testing.T) {
+	type Paint struct {
+		C         Color
+		P         *Color
+		FromBytes Color
+		L         Level
+		T         Celsius
+		Ok        MyBool
+	}
+	in := map[string]interface{}{"C": "red", "P": "green", "FromBytes": []byte("red"), "L": 3, "T": 21.5, "Ok": true}
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Paint
+	err = Loads(blob, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.C != Red || p.P == nil || *p.P != Green || p.FromBytes != Red || p.L != 3 || p.T != 21.5 || !bool(p.Ok) {
+		t.Errorf("bad decode %#v", p)
+	}
+
+	m := map[Color]Level{}
+	blob, _ = Dumps(map[string]int{"red": 1, "green": 2})
+	err = Loads(blob, &m)
+	if err != nil || m[Red] != 1 || m[Green] != 2 {
+		t.Errorf("got %#v %v", m, err)
+	}
+}
+
+type Meters int
+
+type Grams uint16
+
+type Ratio float64
+
+func TestDecodeNamedNumericTypes(t *testing.T) {
+	type Sample struct {
+		Distance Meters
+		Weight   Grams
+		R        Ratio
+		Far      Meters
+		Ptr      *Meters
+		Big      Ratio
+	}
+	huge, _ := new(big.Int).SetString("100000000000000000000", 10)
+	blob, err := Dumps(map[string]interface{}{
+		"Distance": -12,
+		"Weight":   500,
+		"R":        0.25,
+		"Far":      big.NewInt(1 << 40),
+		"Ptr":      7,
+		"Big":      huge,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Sample
+	err = Loads(blob, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Distance != -12 || s.Weight != 500 || s.R != 0.25 || s.Far != 1<<40 || s.Ptr == nil || *s.Ptr != 7 || s.Big != 1e20 {
+		t.Errorf("bad decode %#v", s)
+	}
+
+	// out of range for the underlying type
+	blob, _ = Dumps(map[string]interface{}{"Weight": 70000})
+	if err := Loads(blob, &s); err == nil {
+		t.Error("expected overflow error for Grams")
+	}
+	blob, _ = Dumps(map[string]interface{}{"Far": huge})
+	if err := Loads(blob, &s); err == nil {
+		t.Error("expected overflow error for a bignum into Meters")
+	}
+
+	out, err := Dumps(Sample{Distance: 3})
+	if err != nil || !bytes.Contains(out, []byte{0x68, 'D', 'i', 's', 't', 'a', 'n', 'c', 'e', 0x03}) {
+		t.Errorf("named types encoded as %x %v", out, err)
+	}
+}
+
+func TestEncoderWriteRaw(t *testing.T) {
+	cached, _ := Dumps(map[string]int{"a": 1})
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.StartIndefiniteArray()
+	enc.Encode("head")
+	err := enc.WriteRaw(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.EndIndefinite()
+	var out []interface{}
+	err = Loads(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[1].(map[interface{}]interface{})["a"] != uint64(1) {
+		t.Errorf("got %#v", out)
+	}
+
+	enc = NewEncoder(new(bytes.Buffer))
+	enc.ValidateRaw = true
+	for _, h := range []string{"", "8201", "0101", "1c", "5bffffffffffffffff", "5a0000000a01", "7903e8", "9a0001000001"} {
+		blob, _ := hex.DecodeString(h)
+		if err := enc.WriteRaw(blob); err == nil {
+			t.Errorf("%q: expected validation error", h)
+		}
+	}
+	if err := enc.WriteRaw(cached); err != nil {
+		t.Error(err)
+	}
+	if err := enc.Encode(RawMessage{0x01, 0x02}); err == nil {
+		t.Error("expected RawMessage validation error")
+	}
+}
+
+func TestRejectByteStringKeys(t *testing.T) {
+	// {h'ff': 1, "a": 2}
+	blob, _ := hex.DecodeString("a241ff01616102")
+	var m map[string]int
+	err := Loads(blob, &m)
+	if err != nil || m["\xff"] != 1 || m["a"] != 2 {
+		t.Errorf("default: got %#v %v", m, err)
+	}
+
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.RejectByteStringKeys = true
+	m = nil
+	err = dec.Decode(&m)
+	if err == nil {
+		t.Errorf("expected error for byte string key, got %#v", m)
+	}
+
+	// byte string values are unaffected
+	blob, _ = hex.DecodeString("a1616141ff")
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.RejectByteStringKeys = true
+	var vals map[string]string
+	err = dec.Decode(&vals)
+	if err != nil || vals["a"] != "\xff" {
+		t.Errorf("got %#v %v", vals, err)
+	}
+}
+
+func TestDecodeBareTimestamps(t *testing.T) {
+	type Event struct {
+		At    time.Time
+		Until *time.Time
+	}
+	blob, _ := Dumps(map[string]interface{}{
+		"At":    "2024-02-29T12:30:00Z",
+		"Until": "2024-03-01T08:00:00.5+02:00",
+	})
+	var ev Event
+	err := Loads(blob, &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.At.Equal(time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("bad At %v", ev.At)
+	}
+	if ev.Until == nil || !ev.Until.Equal(time.Date(2024, 3, 1, 6, 0, 0, 5e8, time.UTC)) {
+		t.Errorf("bad Until %v", ev.Until)
+	}
+
+	blob, _ = Dumps(map[string]interface{}{"At": "yesterday"})
+	if err := Loads(blob, &ev); err == nil {
+		t.Error("expected error for a malformed timestamp")
+	}
+}
+
+func TestCompositeMapKeys(t *testing.T) {
+	grid := map[[2]int]string{{0, 0}: "origin", {1, -1}: "se", {10, 2}: "far"}
+	blob, err := Dumps(grid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys sorted by their whole encoding: length first, then bytewise
+	expected := "a3820000666f726967696e820120627365820a0263666172"
+	if hex.EncodeToString(blob) != expected {
+		t.Errorf("got %x, wanted %s", blob, expected)
+	}
+	var grid2 map[[2]int]string
+	err = Loads(blob, &grid2)
+	if err != nil || !reflect.DeepEqual(grid, grid2) {
+		t.Errorf("got %#v %v", grid2, err)
+	}
+
+	hashes := map[[2]byte]int{{1, 2}: 1, {0xff, 0}: 2}
+	blob, err = Dumps(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes2 map[[2]byte]int
+	err = Loads(blob, &hashes2)
+	if err != nil || !reflect.DeepEqual(hashes, hashes2) {
+		t.Errorf("got %#v %v", hashes2, err)
+	}
+
+	type Coord struct {
+		X, Y int
+	}
+	coords := map[Coord]bool{{1, 2}: true, {3, 4}: false}
+	blob, err = Dumps(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coords2 map[Coord]bool
+	err = Loads(blob, &coords2)
+	if err != nil || !reflect.DeepEqual(coords, coords2) {
+		t.Errorf("got %#v %v", coords2, err)
+	}
+}
+
+func TestExtraFields(t *testing.T) {
+	type Msg struct {
+		Name  string                 `cbor:"name"`
+		Extra map[string]interface{} `cbor:",extra"`
+	}
+	blob, err := Dumps(map[string]interface{}{
+		"name":    "a",
+		"version": uint64(3),
+		"tags":    []interface{}{"x", "y"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Msg
+	err = Loads(blob, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Msg{
+		Name: "a",
+		Extra: map[string]interface{}{
+			"version": uint64(3),
+			"tags":    []interface{}{"x", "y"},
+		},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("got %#v", m)
+	}
+
+	// unknown keys go to the map rather than failing
+	dec := NewDecoder(bytes.NewReader(blob))
+	dec.DisallowUnknownFields = true
+	var m2 Msg
+	err = dec.Decode(&m2)
+	if err != nil || !reflect.DeepEqual(m2, expected) {
+		t.Errorf("got %#v %v", m2, err)
+	}
+
+	// the entries are written back beside the fields, not as a field
+	blob, err = Dumps(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back map[string]interface{}
+	err = Loads(blob, &back)
+	want := map[string]interface{}{"name": "a", "version": uint64(3), "tags": []interface{}{"x", "y"}}
+	if err != nil || !reflect.DeepEqual(back, want) {
+		t.Errorf("got %#v %v", back, err)
+	}
+
+	// in canonical order among the fields, never repeating a field's key
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.StructKeyOrder = CanonicalOrder
+	err = enc.Encode(Msg{Name: "a", Extra: map[string]interface{}{"name": "b", "id": 1, "zz": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"id": 1, "zz": 2, "name": "a"}
+	if got := hex.EncodeToString(buf.Bytes()); got != "a362696401627a7a02646e616d656161" {
+		t.Errorf("got %s", got)
+	}
+}
+
+type testColor int
+
+func (c testColor) String() string {
+	switch c {
+	case 0:
+		return "red"
+	case 1:
+		return "green"
+	}
+	return "color(" + strconv.Itoa(int(c)) + ")"
+}
+
+func TestUseStringer(t *testing.T) {
+	type Pixel struct {
+		Color testColor
+		Alpha int
+	}
+	in := Pixel{Color: 1, Alpha: 7}
+
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	err = Loads(blob, &out)
+	if err != nil || out["Color"] != uint64(1) {
+		t.Errorf("default: got %#v %v", out, err)
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.UseStringer = true
+	err = enc.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = nil
+	err = Loads(buf.Bytes(), &out)
+	if err != nil || out["Color"] != "green" || out["Alpha"] != uint64(7) {
+		t.Errorf("stringer: got %#v %v", out, err)
+	}
+
+	// nil pointers are still null
+	buf.Reset()
+	err = enc.Encode((*testColor)(nil))
+	if err != nil || !bytes.Equal(buf.Bytes(), []byte{0xf6}) {
+		t.Errorf("got %x %v", buf.Bytes(), err)
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	one, _ := Dumps([]int{1, 2})
+	two, _ := Dumps("two")
+
+	// not a ByteReader, so NewDecoder buffers it
+	dec := NewDecoder(io.MultiReader(bytes.NewReader(one), bytes.NewReader(two)))
+	dec.UnwrapUnknownTags = true
+	var ints []int
+	err := dec.Decode(&ints)
+	if err != nil || !reflect.DeepEqual(ints, []int{1, 2}) {
+		t.Fatalf("got %v %v", ints, err)
+	}
+	bufr := dec.bufr
+
+	// the rest of the old reader, already buffered, is dropped
+	dec.Reset(io.MultiReader(bytes.NewReader(two)))
+	var s string
+	err = dec.Decode(&s)
+	if err != nil || s != "two" {
+		t.Errorf("got %q %v", s, err)
+	}
+	if dec.bufr != bufr || !dec.UnwrapUnknownTags {
+		t.Error("buffer or options not kept")
+	}
+	if dec.BytesRead() != int64(len(two)) {
+		t.Errorf("offset %d", dec.BytesRead())
+	}
+	err = dec.Decode(&s)
+	if err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// an unbuffered decoder stays unbuffered
+	dec = NewUnbufferedDecoder(bytes.NewReader(one))
+	r := io.MultiReader(bytes.NewReader(two), bytes.NewReader(one))
+	dec.Reset(r)
+	err = dec.Decode(&s)
+	if err != nil || s != "two" {
+		t.Errorf("got %q %v", s, err)
+	}
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, one) {
+		t.Errorf("decoder read ahead: %x left", rest)
+	}
+}
+
+func TestEncoderReset(t *testing.T) {
+	var first, second bytes.Buffer
+	enc := NewBufferedEncoder(&first)
+	enc.SortKeys = false
+	err := enc.Encode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Reset(&second)
+	err = enc.Encode("x")
+	if err == nil {
+		err = enc.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), []byte{0x01}) || !bytes.Equal(second.Bytes(), []byte{0x61, 'x'}) || enc.SortKeys {
+		t.Errorf("got %x and %x", first.Bytes(), second.Bytes())
+	}
+}
+
+func benchmarkEncodeShortLived(b *testing.B, pooled bool) {
+	v := benchPoint{X: 1, Y: 2, Label: "p"}
+	var pool sync.Pool
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		var enc *Encoder
+		if pooled {
+			if x := pool.Get(); x != nil {
+				enc = x.(*Encoder)
+				enc.Reset(&buf)
+			} else {
+				enc = NewBufferedEncoder(&buf)
+			}
+		} else {
+			enc = NewBufferedEncoder(&buf)
+		}
+		err := enc.Encode(v)
+		if err == nil {
+			err = enc.Flush()
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if pooled {
+			pool.Put(enc)
+		}
+	}
+}
+
+func BenchmarkEncodeShortLivedNew(b *testing.B) {
+	benchmarkEncodeShortLived(b, false)
+}
+
+func BenchmarkEncodeShortLivedPooled(b *testing.B) {
+	benchmarkEncodeShortLived(b, true)
+}
+
+func TestMapPairs(t *testing.T) {
+	type Doc struct {
+		Attrs map[string]int `cbor:"attrs,pairs"`
+	}
+	in := Doc{Attrs: map[string]int{"b": 2, "a": 1}}
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"attrs": ["a", 1, "b", 2]}
+	expected, _ := hex.DecodeString("a165617474727384616101616202")
+	if !bytes.Equal(blob, expected) {
+		t.Errorf("got %x", blob)
+	}
+	var out Doc
+	err = Loads(blob, &out)
+	if err != nil || !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v %v", out, err)
+	}
+
+	// a plain map is still accepted
+	blob, _ = Dumps(map[string]interface{}{"attrs": map[string]int{"c": 3}})
+	err = Loads(blob, &out)
+	if err != nil || !reflect.DeepEqual(out.Attrs, map[string]int{"c": 3}) {
+		t.Errorf("got %#v %v", out, err)
+	}
+
+	blob, _ = Dumps(map[string]interface{}{"attrs": []interface{}{"a", 1, "b"}})
+	err = Loads(blob, &out)
+	if err == nil {
+		t.Error("expected error for a key without a value")
+	}
+
+	// without the option an array doesn't fit a map
+	var plain struct {
+		Attrs map[string]int `cbor:"attrs"`
+	}
+	blob, _ = Dumps(map[string]interface{}{"attrs": []interface{}{"a", 1}})
+	err = Loads(blob, &plain)
+	if err == nil {
+		t.Error("expected error decoding an array into a map")
+	}
+}
+
+func TestStrictMinimalIntegers(t *testing.T) {
+	nonMinimal := []string{
+		"1805",               // 5 as uint8
+		"190017",             // 23 as uint16
+		"1a0000ffff",         // 65535 as uint32
+		"1b00000000ffffffff", // 4294967295 as uint64
+		"3817",               // -24 as uint8
+		"5801ff",             // byte string length
+		"780161",             // text string length
+		"980101",             // array length
+		"82011801",           // nested element
+		"d80a6161",           // tag number
+	}
+	for _, h := range nonMinimal {
+		blob, _ := hex.DecodeString(h)
+		var out interface{}
+		err := Loads(blob, &out)
+		if err != nil {
+			t.Errorf("%s: lenient decode failed: %v", h, err)
+		}
+
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.Strict = true
+		err = dec.Decode(&out)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: expected a SyntaxError, got %v", h, err)
+		}
+	}
+
+	minimal := []string{"17", "1818", "190100", "1a00010000", "1b0000000100000000", "f93c00", "fa47c35000"}
+	for _, h := range minimal {
+		blob, _ := hex.DecodeString(h)
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.Strict = true
+		var out interface{}
+		err := dec.Decode(&out)
+		if err != nil {
+			t.Errorf("%s: strict decode failed: %v", h, err)
+		}
+	}
+}
+
+type testIDs []string
+type testScores map[string]int
+type testGrid [2][2]int
+type testBlob []byte
+type testName string
+
+func TestNamedContainers(t *testing.T) {
+	ids := testIDs{"a", "b"}
+	scores := testScores{"x": 1}
+	grid := testGrid{{1, 2}, {3, 4}}
+	blob := testBlob{1, 2, 3}
+	name := testName("n")
+	pids := &ids
+
+	cases := []struct {
+		in       interface{}
+		expected string
+	}{
+		{ids, "8261616162"},
+		{&ids, "8261616162"},
+		{&pids, "8261616162"},
+		{scores, "a1617801"},
+		{&scores, "a1617801"},
+		{grid, "82820102820304"},
+		{&grid, "82820102820304"},
+		{blob, "43010203"},
+		{&blob, "43010203"},
+		{name, "616e"},
+		{&name, "616e"},
+		{[]interface{}{&ids, &scores}, "828261616162a1617801"},
+		{(*testIDs)(nil), "f6"},
+	}
+	for _, c := range cases {
+		out, err := Dumps(c.in)
+		if err != nil {
+			t.Errorf("%T: %v", c.in, err)
+			continue
+		}
+		if hex.EncodeToString(out) != c.expected {
+			t.Errorf("%T: got %x, expected %s", c.in, out, c.expected)
+		}
+	}
+
+	type Record struct {
+		IDs    *testIDs
+		Scores *testScores
+		Grid   *testGrid
+		Blob   *testBlob
+		Name   *testName
+		Any    interface{}
+	}
+	in := Record{IDs: &ids, Scores: &scores, Grid: &grid, Blob: &blob, Name: &name, Any: &ids}
+	data, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Record
+	err = Loads(data, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*out.IDs, ids) || !reflect.DeepEqual(*out.Scores, scores) || *out.Grid != grid ||
+		!bytes.Equal(*out.Blob, blob) || *out.Name != name || !reflect.DeepEqual(out.Any, []interface{}{"a", "b"}) {
+		t.Errorf("got %#v", out)
+	}
+
+	// a nil pointer to a named slice is allocated
+	var pout *testIDs
+	data, _ = Dumps(&pids)
+	err = Loads(data, &pout)
+	if err != nil || pout == nil || !reflect.DeepEqual(*pout, ids) {
+		t.Errorf("got %v %v", pout, err)
+	}
+}
+
+// arenaValue decodes an array of unsigned integers into a preallocated
+// buffer, as a custom DecodeValue.
+type arenaValue struct {
+	buf []uint64
+	n   int
+}
+
+type arenaSlot struct {
+	a *arenaValue
+}
+
+func (a *arenaValue) Prepare() error                     { return nil }
+func (a *arenaValue) SetBytes(buf []byte) error          { return errors.New("not an array") }
+func (a *arenaValue) SetBignum(x *big.Int) error         { return errors.New("not an array") }
+func (a *arenaValue) SetUint(u uint64) error             { return errors.New("not an array") }
+func (a *arenaValue) SetInt(i int64) error               { return errors.New("not an array") }
+func (a *arenaValue) SetFloat32(f float32) error         { return errors.New("not an array") }
+func (a *arenaValue) SetFloat64(d float64) error         { return errors.New("not an array") }
+func (a *arenaValue) SetNil() error                      { return errors.New("not an array") }
+func (a *arenaValue) SetBool(b bool) error               { return errors.New("not an array") }
+func (a *arenaValue) SetString(s string) error           { return errors.New("not an array") }
+func (a *arenaValue) CreateMap() (DecodeValueMap, error) { return nil, errors.New("not an array") }
+func (a *arenaValue) CreateArray(makeLength int) (DecodeValueArray, error) {
+	a.n = 0
+	return a, nil
+}
+func (a *arenaValue) CreateTag(aux uint64, decoder TagDecoder) (DecodeValue, interface{}, error) {
+	return nil, nil, errors.New("not an array")
+}
+func (a *arenaValue) SetTag(aux uint64, v DecodeValue, decoder TagDecoder, i interface{}) error {
+	return errors.New("not an array")
+}
+
+func (a *arenaValue) GetArrayValue(index uint64) (DecodeValue, error) {
+	if a.n >= len(a.buf) {
+		return nil, errors.New("arena full")
+	}
+	return arenaSlot{a}, nil
+}
+func (a *arenaValue) AppendArray(value DecodeValue) error { a.n++; return nil }
+func (a *arenaValue) EndArray() error                     { return nil }
+
+func (s arenaSlot) Prepare() error                     { return nil }
+func (s arenaSlot) SetUint(u uint64) error             { s.a.buf[s.a.n] = u; return nil }
+func (s arenaSlot) SetBytes(buf []byte) error          { return errors.New("not a uint") }
+func (s arenaSlot) SetBignum(x *big.Int) error         { return errors.New("not a uint") }
+func (s arenaSlot) SetInt(i int64) error               { return errors.New("not a uint") }
+func (s arenaSlot) SetFloat32(f float32) error         { return errors.New("not a uint") }
+func (s arenaSlot) SetFloat64(d float64) error         { return errors.New("not a uint") }
+func (s arenaSlot) SetNil() error                      { return errors.New("not a uint") }
+func (s arenaSlot) SetBool(b bool) error               { return errors.New("not a uint") }
+func (s arenaSlot) SetString(str string) error         { return errors.New("not a uint") }
+func (s arenaSlot) CreateMap() (DecodeValueMap, error) { return nil, errors.New("not a uint") }
+func (s arenaSlot) CreateArray(makeLength int) (DecodeValueArray, error) {
+	return nil, errors.New("not a uint")
+}
+func (s arenaSlot) CreateTag(aux uint64, decoder TagDecoder) (DecodeValue, interface{}, error) {
+	return nil, nil, errors.New("not a uint")
+}
+func (s arenaSlot) SetTag(aux uint64, v DecodeValue, decoder TagDecoder, i interface{}) error {
+	return errors.New("not a uint")
+}
+
+func TestDecodeIntoCustomValue(t *testing.T) {
+	a := &arenaValue{buf: make([]uint64, 4)}
+	blob, _ := Dumps([]uint64{7, 8, 1 << 40})
+	dec := NewDecoder(bytes.NewReader(blob))
+	err := dec.DecodeInto(a)
+	if err != nil || a.n != 3 || !reflect.DeepEqual(a.buf, []uint64{7, 8, 1 << 40, 0}) {
+		t.Errorf("got %v %d %v", a.buf, a.n, err)
+	}
+
+	blob, _ = Dumps([]uint64{1, 2, 3, 4, 5})
+	dec = NewDecoder(bytes.NewReader(blob))
+	err = dec.DecodeInto(a)
+	if err == nil {
+		t.Error("expected an error overflowing the arena")
+	}
+	blob, _ = Dumps([]interface{}{1, "x"})
+	dec = NewDecoder(bytes.NewReader(blob))
+	err = dec.DecodeInto(a)
+	if err == nil {
+		t.Error("expected an error for a string element")
+	}
+}
+
+type testCodeError struct {
+	code int
+}
+
+func (e testCodeError) Error() string {
+	return "code " + strconv.Itoa(e.code)
+}
+
+func (e testCodeError) String() string {
+	return "stringer"
+}
+
+func TestEncodeErrorsAsString(t *testing.T) {
+	type Result struct {
+		Err   error
+		Code  testCodeError
+		Other error
+	}
+	in := Result{Err: errors.New("boom"), Code: testCodeError{3}}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.EncodeErrorsAsString = true
+	enc.UseStringer = true
+	err := enc.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	err = Loads(buf.Bytes(), &out)
+	expected := map[string]interface{}{"Err": "boom", "Code": "code 3", "Other": nil}
+	if err != nil || !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %#v %v", out, err)
+	}
+
+	// off by default: the error's struct has no exported fields
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = nil
+	err = Loads(blob, &out)
+	if err != nil || !reflect.DeepEqual(out["Err"], map[interface{}]interface{}{}) {
+		t.Errorf("got %#v %v", out, err)
+	}
+}
+
+func TestUnmarshalFirst(t *testing.T) {
+	cases := []struct {
+		item string
+		v    interface{}
+	}{
+		{"05", new(int)},
+		{"3903e7", new(int)},
+		{"6568656c6c6f", new(string)},
+		{"43010203", new([]byte)},
+		{"5f4201024103ff", new([]byte)},
+		{"83010203", new([]int)},
+		{"9f0102ff", new([]int)},
+		{"a1616101", new(map[string]int)},
+		{"c11a514b67b0", new(interface{})},
+		{"fb3ff199999999999a", new(float64)},
+		{"f6", new(interface{})},
+	}
+	tail := []byte{0xde, 0xad, 0x00}
+	for _, c := range cases {
+		item, _ := hex.DecodeString(c.item)
+		data := append(item, tail...)
+		rest, err := UnmarshalFirst(data, c.v)
+		if err != nil || !bytes.Equal(rest, tail) {
+			t.Errorf("%s: got rest %x, %v", c.item, rest, err)
+		}
+		rest, err = UnmarshalFirst(item, c.v)
+		if err != nil || rest == nil || len(rest) != 0 {
+			t.Errorf("%s: got rest %x, %v", c.item, rest, err)
+		}
+	}
+
+	var n int
+	_, err := UnmarshalFirst([]byte{0x19, 0x01}, &n)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestTypedNilInInterface(t *testing.T) {
+	type T struct{ A int }
+	var p *T
+	var bi *big.Int
+	var tm *time.Time
+	var ip *net.IP
+	var u *url.URL
+	cases := []interface{}{p, bi, tm, ip, u, (*RawMessage)(nil), (*testColor)(nil), (*testCodeError)(nil)}
+	for _, c := range cases {
+		var i interface{} = c
+		for _, v := range []interface{}{
+			i,
+			[]interface{}{i},
+			map[string]interface{}{"k": i},
+			struct{ V interface{} }{i},
+		} {
+			blob, err := Dumps(v)
+			if err != nil {
+				t.Errorf("%T in %T: %v", c, v, err)
+				continue
+			}
+			if !bytes.HasSuffix(blob, []byte{0xf6}) {
+				t.Errorf("%T in %T: got %x, expected null", c, v, blob)
+			}
+		}
+	}
+}
+
+func TestSets(t *testing.T) {
+	type Perms struct {
+		Roles map[string]struct{}
+	}
+	in := Perms{Roles: map[string]struct{}{"b": {}, "a": {}}}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.EncodeSets = true
+	err := enc.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"Roles": 258(["a", "b"])}
+	if hex.EncodeToString(buf.Bytes()) != "a165526f6c6573d901028261616162" {
+		t.Errorf("got %x", buf.Bytes())
+	}
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.DecodeSets = true
+	var out Perms
+	err = dec.Decode(&out)
+	if err != nil || !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v %v", out, err)
+	}
+
+	// duplicates collapse in a map, and stay in a slice
+	blob, _ := hex.DecodeString("d9010283616161626161")
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.DecodeSets = true
+	var set map[string]struct{}
+	err = dec.Decode(&set)
+	if err != nil || !reflect.DeepEqual(set, map[string]struct{}{"a": {}, "b": {}}) {
+		t.Errorf("got %#v %v", set, err)
+	}
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.DecodeSets = true
+	var list []string
+	err = dec.Decode(&list)
+	if err != nil || !reflect.DeepEqual(list, []string{"a", "b", "a"}) {
+		t.Errorf("got %#v %v", list, err)
+	}
+	dec = NewDecoder(bytes.NewReader(blob))
+	dec.DecodeSets = true
+	var any interface{}
+	err = dec.Decode(&any)
+	if err != nil || !reflect.DeepEqual(any, []interface{}{"a", "b", "a"}) {
+		t.Errorf("got %#v %v", any, err)
+	}
+
+	// off by default
+	any = nil
+	err = Loads(blob, &any)
+	if tag, ok := any.(*CBORTag); err != nil || !ok || tag.Tag != 258 {
+		t.Errorf("got %#v %v", any, err)
+	}
+	err = Loads(blob, &set)
+	if err == nil {
+		t.Error("expected an error decoding a tagged array into a map without DecodeSets")
+	}
+}
+
+func TestEncoderMaxBytes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.MaxBytes = 10
+	err := enc.Encode([]interface{}{"abc", []int{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the budget is per call
+	err = enc.Encode([]interface{}{"abc", []int{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enc.Encode(strings.Repeat("x", 10))
+	if err == nil || !strings.Contains(err.Error(), "MaxBytes") {
+		t.Errorf("expected MaxBytes error, got %v", err)
+	}
+
+	// a cycle stops at the limit rather than running forever
+	type node struct {
+		Next interface{}
+	}
+	n := &node{}
+	n.Next = n
+	buf.Reset()
+	enc.MaxBytes = 1 << 10
+	err = enc.Encode(n)
+	if err == nil || buf.Len() > 1<<10 {
+		t.Errorf("got %d bytes, %v", buf.Len(), err)
+	}
+}
+
+func TestEncoderDetectCycles(t *testing.T) {
+	type node struct {
+		Val  int
+		Next *node
+	}
+	a := &node{Val: 1}
+	b := &node{Val: 2, Next: a}
+	a.Next = b
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.DetectCycles = true
+	err := enc.Encode(a)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+
+	m := map[string]interface{}{}
+	m["self"] = m
+	err = enc.Encode(m)
+	if err == nil {
+		t.Error("expected a cycle error for a map")
+	}
+
+	s := make([]interface{}, 1)
+	s[0] = s
+	err = enc.Encode(s)
+	if err == nil {
+		t.Error("expected a cycle error for a slice")
+	}
+
+	// shared but acyclic values are fine
+	leaf := &node{Val: 3}
+	buf.Reset()
+	err = enc.Encode([]*node{leaf, leaf, {Val: 4, Next: leaf}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []node
+	err = Loads(buf.Bytes(), &out)
+	if err != nil || len(out) != 3 || out[2].Next.Val != 3 {
+		t.Errorf("got %#v %v", out, err)
+	}
+}
+
+func TestTagContentTypes(t *testing.T) {
+	bad := []string{
+		"c01a514b67b0",   // tag 0 around an integer
+		"c16161",         // tag 1 around a text string
+		"c1f5",           // tag 1 around true
+		"c46161",         // tag 4 around a text string
+		"d82043010203",   // tag 32 around bytes
+		"d8256161",       // tag 37 around a text string
+		"d8254401020304", // tag 37 around 4 bytes
+	}
+	for _, h := range bad {
+		blob, _ := hex.DecodeString(h)
+		dec := NewDecoder(bytes.NewReader(blob))
+		RegisterStandardTags(dec)
+		var out interface{}
+		err := dec.Decode(&out)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %#v", h, out)
+		}
+		// checked without TagDecoders too
+		out = nil
+		err = Loads(blob, &out)
+		var tce *TagContentError
+		if !errors.As(err, &tce) {
+			t.Errorf("%s: expected a TagContentError, got %v", h, err)
+		}
+		var se *SyntaxError
+		if !errors.As(err, &se) || se.Offset != tce.Offset {
+			t.Errorf("%s: expected a SyntaxError too, got %v", h, err)
+		}
+	}
+
+	// a custom TagDecoder decides what content it accepts
+	tagged, _ := hex.DecodeString("c16474657874") // 1("text")
+	custom := NewDecoder(bytes.NewReader(tagged))
+	if err := custom.RegisterTagType(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	var text interface{}
+	if err := custom.Decode(&text); err != nil || text != "text" {
+		t.Errorf("custom tag 1 decoder: got %#v %v", text, err)
+	}
+
+	// a longer length form is checked once read
+	blob, _ := hex.DecodeString("d825581100112233445566778899aabbccddeeff00")
+	var out interface{}
+	err := Loads(blob, &out)
+	if err == nil {
+		t.Errorf("expected an error for a 17 byte UUID, got %#v", out)
+	}
+
+	good := []string{
+		"c074323031332d30332d32315432303a30343a30305a", // tag 0 date/time
+		"c11a514b67b0",                           // tag 1 integer
+		"c1fb41d452d9ec200000",                   // tag 1 float
+		"d8255000112233445566778899aabbccddeeff", // tag 37 UUID
+	}
+	for _, h := range good {
+		blob, _ := hex.DecodeString(h)
+		dec := NewDecoder(bytes.NewReader(blob))
+		RegisterStandardTags(dec)
+		var out interface{}
+		err := dec.Decode(&out)
+		if err != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+}
+
+func TestUint64Boundaries(t *testing.T) {
+	cases := []struct {
+		hex string
+		u   uint64
+	}{
+		{"00", 0},
+		{"17", 23},
+		{"1818", 24},
+		{"18ff", math.MaxUint8},
+		{"190100", math.MaxUint8 + 1},
+		{"19ffff", math.MaxUint16},
+		{"1a00010000", math.MaxUint16 + 1},
+		{"1affffffff", math.MaxUint32},
+		{"1b0000000100000000", math.MaxUint32 + 1},
+		{"1b7fffffffffffffff", math.MaxInt64},
+		{"1b8000000000000000", math.MaxInt64 + 1},
+		{"1bffffffffffffffff", math.MaxUint64},
+	}
+	for _, c := range cases {
+		blob, _ := hex.DecodeString(c.hex)
+
+		var u uint64
+		err := Loads(blob, &u)
+		if err != nil || u != c.u {
+			t.Errorf("%s into uint64: got %d %v", c.hex, u, err)
+		}
+
+		var i interface{}
+		err = Loads(blob, &i)
+		if err != nil || i != c.u {
+			t.Errorf("%s into interface{}: got %#v %v", c.hex, i, err)
+		}
+
+		var s int64
+		err = Loads(blob, &s)
+		if c.u > math.MaxInt64 {
+			if err == nil {
+				t.Errorf("%s into int64: expected overflow, got %d", c.hex, s)
+			}
+		} else if err != nil || s != int64(c.u) {
+			t.Errorf("%s into int64: got %d %v", c.hex, s, err)
+		}
+	}
+
+	// negative integers: -1 - n, from -1 down to -2^64
+	negCases := []struct {
+		hex string
+		n   *big.Int
+	}{
+		{"20", big.NewInt(-1)},
+		{"3b7fffffffffffffff", big.NewInt(math.MinInt64)},
+		{"3b8000000000000000", new(big.Int).Sub(big.NewInt(math.MinInt64), big.NewInt(1))},
+		{"3bffffffffffffffff", new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 64))},
+	}
+	for _, c := range negCases {
+		blob, _ := hex.DecodeString(c.hex)
+
+		var s int64
+		err := Loads(blob, &s)
+		if c.n.IsInt64() {
+			if err != nil || s != c.n.Int64() {
+				t.Errorf("%s into int64: got %d %v", c.hex, s, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s into int64: expected overflow, got %d", c.hex, s)
+		}
+
+		var i interface{}
+		err = Loads(blob, &i)
+		if err != nil {
+			t.Errorf("%s into interface{}: %v", c.hex, err)
+			continue
+		}
+		switch x := i.(type) {
+		case int64:
+			if !c.n.IsInt64() || x != c.n.Int64() {
+				t.Errorf("%s into interface{}: got %d", c.hex, x)
+			}
+		case big.Int:
+			if x.Cmp(c.n) != 0 {
+				t.Errorf("%s into interface{}: got %s", c.hex, x.String())
+			}
+		default:
+			t.Errorf("%s into interface{}: got %T", c.hex, i)
+		}
+
+		var u uint64
+		err = Loads(blob, &u)
+		if err == nil {
+			t.Errorf("%s into uint64: expected an error, got %d", c.hex, u)
+		}
+	}
+}
+
+func TestDecodeBigFloat(t *testing.T) {
+	cases := []struct {
+		hex string
+		f   float64
+	}{
+		{"f93e00", 1.5},                         // half
+		{"fa3dcccccd", float64(float32(0.1))},   // single
+		{"fb3fb999999999999a", 0.1},             // double
+		{"fb7fefffffffffffff", math.MaxFloat64}, // largest double
+		{"fb0000000000000001", 5e-324},          // smallest subnormal
+		{"f9fc00", math.Inf(-1)},
+	}
+	for _, c := range cases {
+		blob, _ := hex.DecodeString(c.hex)
+		expected := new(big.Float).SetFloat64(c.f)
+
+		var f64 float64
+		err := Loads(blob, &f64)
+		if err != nil || f64 != c.f {
+			t.Errorf("%s into float64: got %v %v", c.hex, f64, err)
+		}
+
+		var bf big.Float
+		err = Loads(blob, &bf)
+		if err != nil || bf.Cmp(expected) != 0 {
+			t.Errorf("%s into big.Float: got %s %v", c.hex, bf.String(), err)
+		}
+		// exact: the same value as the float64 path, bit for bit
+		if back, acc := bf.Float64(); back != f64 || acc != big.Exact {
+			t.Errorf("%s: big.Float %s is not exactly %v", c.hex, bf.String(), f64)
+		}
+
+		var pbf *big.Float
+		err = Loads(blob, &pbf)
+		if err != nil || pbf == nil || pbf.Cmp(expected) != 0 {
+			t.Errorf("%s into *big.Float: got %v %v", c.hex, pbf, err)
+		}
+
+		dec := NewDecoder(bytes.NewReader(blob))
+		dec.FloatDecodeMode = FloatDecodeBigFloat
+		var i interface{}
+		err = dec.Decode(&i)
+		if ibf, ok := i.(*big.Float); err != nil || !ok || ibf.Cmp(expected) != 0 {
+			t.Errorf("%s into interface{}: got %#v %v", c.hex, i, err)
+		}
+	}
+
+	var bf big.Float
+	err := Loads([]byte{0xf9, 0x7e, 0x00}, &bf)
+	if err == nil {
+		t.Error("expected an error decoding NaN into a big.Float")
+	}
+}
+
+func TestTextIntoBytes(t *testing.T) {
+	blob, _ := Dumps("héllo")
+
+	var b []byte
+	err := Loads(blob, &b)
+	if err != nil || string(b) != "héllo" {
+		t.Errorf("got %q %v", b, err)
+	}
+
+	var nb testBlob
+	err = Loads(blob, &nb)
+	if err != nil || string(nb) != "héllo" {
+		t.Errorf("got %q %v", nb, err)
+	}
+
+	var a [6]byte
+	err = Loads(blob, &a)
+	if err != nil || string(a[:]) != "héllo" {
+		t.Errorf("got %q %v", a, err)
+	}
+
+	var short [4]byte
+	err = Loads(blob, &short)
+	if err == nil {
+		t.Errorf("expected a length error, got %q", short)
+	}
+
+	var ints []int
+	err = Loads(blob, &ints)
+	var ute *UnmarshalTypeError
+	if !errors.As(err, &ute) {
+		t.Errorf("expected an UnmarshalTypeError, got %v", err)
+	}
+}
+
+func TestInlineFields(t *testing.T) {
+	type Meta struct {
+		Name    string `cbor:"name"`
+		Version int    `cbor:"version"`
+	}
+	type Audit struct {
+		By string `cbor:"by"`
+	}
+	type Config struct {
+		Name  string `cbor:"name"`
+		Meta  Meta   `cbor:",inline"`
+		Audit *Audit `cbor:",inline"`
+		Port  int    `cbor:"port"`
+	}
+	in := Config{Name: "top", Meta: Meta{Name: "hidden", Version: 2}, Audit: &Audit{By: "ops"}, Port: 80}
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flat map[string]interface{}
+	err = Loads(blob, &flat)
+	expected := map[string]interface{}{"name": "top", "version": uint64(2), "by": "ops", "port": uint64(80)}
+	if err != nil || !reflect.DeepEqual(flat, expected) {
+		t.Errorf("got %#v %v", flat, err)
+	}
+
+	var out Config
+	err = Loads(blob, &out)
+	in.Meta.Name = "" // the parent's field wins the collision
+	if err != nil || !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v %v", out, err)
+	}
+
+	// a nil inline pointer contributes no keys
+	blob, err = Dumps(Config{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat = nil
+	err = Loads(blob, &flat)
+	if err != nil || len(flat) != 3 || flat["by"] != nil {
+		t.Errorf("got %#v %v", flat, err)
+	}
+}
+
+func benchmarkDecodeLargeMap(b *testing.B, target func() interface{}) {
+	ob := make(map[string]int, 100000)
+	for i := 0; i < 100000; i++ {
+		ob[strconv.Itoa(i)] = i
+	}
+	blob, err := Dumps(ob)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(blob)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Loads(blob, target())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeLargeMapStringInt(b *testing.B) {
+	benchmarkDecodeLargeMap(b, func() interface{} { return new(map[string]int) })
+}
+
+func BenchmarkDecodeLargeMapInterface(b *testing.B) {
+	benchmarkDecodeLargeMap(b, func() interface{} { return new(interface{}) })
+}
+
+type testEvent struct {
+	Name string
+	At   int64
+}
+
+func TestRegisterTagType(t *testing.T) {
+	ev := testEvent{Name: "start", At: 12}
+	blob, err := Dumps([]interface{}{
+		&CBORTag{Tag: 1000, WrappedObject: ev},
+		&CBORTag{Tag: 1001, WrappedObject: ev},
+		&CBORTag{Tag: 1002, WrappedObject: "other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(bytes.NewReader(blob))
+	if err = dec.RegisterTagType(1000, testEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = dec.RegisterTagType(1001, (*testEvent)(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err = dec.RegisterTagType(1002, nil); err == nil {
+		t.Error("expected an error for a nil prototype")
+	}
+	var out []interface{}
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("got %#v", out)
+	}
+	if out[0] != ev {
+		t.Errorf("got %#v", out[0])
+	}
+	if p, ok := out[1].(*testEvent); !ok || *p != ev {
+		t.Errorf("got %#v", out[1])
+	}
+	if tag, ok := out[2].(*CBORTag); !ok || tag.Tag != 1002 {
+		t.Errorf("got %#v", out[2])
+	}
+
+	// into a field of the registered type
+	var typed struct {
+		E testEvent
+	}
+	blob, _ = Dumps(map[string]interface{}{"E": &CBORTag{Tag: 1000, WrappedObject: ev}})
+	dec = NewDecoder(bytes.NewReader(blob))
+	if err = dec.RegisterTagType(1000, testEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	err = dec.Decode(&typed)
+	if err != nil || typed.E != ev {
+		t.Errorf("got %#v %v", typed, err)
+	}
+}
+
+func TestLoadsLeavesTargetOnEOF(t *testing.T) {
+	for _, blob := range [][]byte{nil, {}} {
+		v := map[string]int{"keep": 1}
+		err := Loads(blob, &v)
+		if !errors.Is(err, io.EOF) || err == io.EOF || !reflect.DeepEqual(v, map[string]int{"keep": 1}) {
+			t.Errorf("%x: got %v %v", blob, v, err)
+		}
+	}
+
+	// an initial byte whose argument or content is missing, before
+	// anything is stored
+	for _, c := range []byte{0x18, 0x19, 0x1a, 0x1b, 0x38, 0x41, 0x61, 0xc1, 0xf9, 0xfa, 0xfb} {
+		n := 7
+		err := Loads([]byte{c}, &n)
+		if err != io.ErrUnexpectedEOF || n != 7 {
+			t.Errorf("%x: got %d %v", c, n, err)
+		}
+		var i interface{} = "keep"
+		err = Loads([]byte{c}, &i)
+		if err != io.ErrUnexpectedEOF || i != "keep" {
+			t.Errorf("%x: got %#v %v", c, i, err)
+		}
+	}
+}
+
+func BenchmarkEncodeMixedSlice(b *testing.B) {
+	ob := make([]interface{}, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		switch i % 5 {
+		case 0:
+			ob = append(ob, i)
+		case 1:
+			ob = append(ob, "item"+strconv.Itoa(i))
+		case 2:
+			ob = append(ob, float64(i)/3)
+		case 3:
+			ob = append(ob, i%2 == 0)
+		case 4:
+			ob = append(ob, []byte{byte(i)})
+		}
+	}
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := enc.Encode(ob)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLyingByteStringLength(t *testing.T) {
+	// byte and text strings claiming 1<<40 bytes with only a few present
+	for _, h := range []string{"5b0000010000000000010203", "7b0000010000000000616263"} {
+		blob, _ := hex.DecodeString(h)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var out interface{}
+		err := Loads(blob, &out)
+		runtime.ReadMemStats(&after)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: wanted io.ErrUnexpectedEOF got %v", h, err)
+		}
+		if grew := after.TotalAlloc - before.TotalAlloc; grew > 4*byteBatch {
+			t.Errorf("%s: allocated %d bytes for a short input", h, grew)
+		}
+	}
+}
+
+type testConfig struct {
+	Host    string        `cbor:"host,default=localhost"`
+	Port    int           `cbor:"port,default=8080"`
+	Verbose bool          `cbor:"verbose,default=true"`
+	Timeout time.Duration `cbor:"timeout,default=5s"`
+	Ratio   *float64      `cbor:"ratio,default=0.5"`
+	Addr    netip.Addr    `cbor:"addr,default=127.0.0.1"`
+	Name    string        `cbor:"name"`
+}
+
+func TestFieldDefaults(t *testing.T) {
+	// {"name": "x", "port": 0}
+	blob, _ := hex.DecodeString("a2646e616d65617864706f727400")
+	var out testConfig
+	err := Loads(blob, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratio := 0.5
+	want := testConfig{
+		Host:    "localhost",
+		Port:    0, // present in the map, so the default doesn't apply
+		Verbose: true,
+		Timeout: 5 * time.Second,
+		Ratio:   &ratio,
+		Addr:    netip.MustParseAddr("127.0.0.1"),
+		Name:    "x",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %+v, wanted %+v", out, want)
+	}
+
+	// each decode gets its own pointer
+	var again testConfig
+	err = Loads([]byte{0xa0}, &again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Ratio == out.Ratio || *again.Ratio != 0.5 || again.Port != 8080 {
+		t.Errorf("got %+v", again)
+	}
+
+	// a default which doesn't parse is reported when it's needed
+	var bad struct {
+		N uint8 `cbor:"n,default=300"`
+	}
+	err = Loads([]byte{0xa0}, &bad)
+	if err == nil || !strings.Contains(err.Error(), "bad default") {
+		t.Errorf("expected bad default error, got %v", err)
+	}
+	err = Loads([]byte{0xa1, 0x61, 'n', 0x03}, &bad)
+	if err != nil || bad.N != 3 {
+		t.Errorf("got %v, %v", bad.N, err)
+	}
+
+	// defaults backed by a slice aren't shared between decodes
+	type withIP struct {
+		IP net.IP `cbor:"ip,default=10.0.0.1"`
+	}
+	var a, b withIP
+	if err = Loads([]byte{0xa0}, &a); err != nil {
+		t.Fatal(err)
+	}
+	a.IP[len(a.IP)-1] = 99
+	if err = Loads([]byte{0xa0}, &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.IP.String() != "10.0.0.1" {
+		t.Errorf("default changed to %s", b.IP)
+	}
+}
+
+func TestCompareEncodedKeys(t *testing.T) {
+	// in canonical order; the last is an indefinite length "a"
+	ordered := []string{"0a", "20", "f4", "1864", "617a", "626161", "811864", "7f6161ff"}
+	keys := make([][]byte, len(ordered))
+	for i, h := range ordered {
+		keys[i], _ = hex.DecodeString(h)
+	}
+	for i := range keys {
+		for j := range keys {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := CompareEncodedKeys(keys[i], keys[j]); got != want {
+				t.Errorf("CompareEncodedKeys(%s, %s) = %d, wanted %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	// the same order the encoder sorts map keys in
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	enc.SortKeys = true
+	err := enc.Encode(map[interface{}]int{10: 0, -1: 0, false: 0, 100: 0, "z": 0, "aa": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a60a002000f400186400617a0062616100"
+	if got := hex.EncodeToString(buf.Bytes()); got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+}
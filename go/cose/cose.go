@@ -0,0 +1,199 @@
+// Package cose provides the COSE_Sign1 structure of RFC 9052 on top of
+// the cbor package: encoding and decoding the tag 18 array, and building
+// the Sig_structure which is what actually gets signed.
+//
+// Signing and verifying are left to callbacks, so any signature
+// algorithm can be used without this package depending on it.
+package cose
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	cbor "github.com/whyrusleeping/cbor/go"
+)
+
+// Tag of a COSE_Sign1 message.
+const TagSign1 uint64 = 18
+
+// Common header labels.
+const (
+	HeaderAlgorithm   int64 = 1
+	HeaderCritical    int64 = 2
+	HeaderContentType int64 = 3
+	HeaderKeyID       int64 = 4
+)
+
+// Common algorithm identifiers, the value of HeaderAlgorithm.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgES384 int64 = -35
+	AlgES512 int64 = -36
+	AlgPS256 int64 = -37
+)
+
+// Sign1 is a COSE_Sign1 message: a payload with a single signature.
+type Sign1 struct {
+	// Encoded protected header map, covered by the signature. Build it
+	// with EncodeHeaders; nil means no protected headers.
+	Protected []byte
+
+	// Headers which aren't covered by the signature. Nil encodes as an
+	// empty map.
+	Unprotected map[interface{}]interface{}
+
+	// Nil for a detached payload, which is written as null and must be
+	// supplied separately to sign and verify.
+	Payload []byte
+
+	Signature []byte
+}
+
+// EncodeHeaders encodes a header map for Sign1.Protected. An empty map
+// gives nil, as RFC 9052 requires a zero-length protected header rather
+// than an encoded empty map.
+func EncodeHeaders(h map[interface{}]interface{}) ([]byte, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	return cbor.Dumps(h)
+}
+
+// ProtectedHeaders decodes the protected header map.
+func (s *Sign1) ProtectedHeaders() (map[interface{}]interface{}, error) {
+	h := map[interface{}]interface{}{}
+	if len(s.Protected) == 0 {
+		return h, nil
+	}
+	err := cbor.Loads(s.Protected, &h)
+	if err != nil {
+		return nil, fmt.Errorf("cose: protected headers: %v", err)
+	}
+	return h, nil
+}
+
+// SigStructure returns the encoded Sig_structure for the message,
+//
+//	["Signature1", protected, external_aad, payload]
+//
+// the bytes a signature is made over. payload is used in place of
+// s.Payload when the payload is detached.
+func (s *Sign1) SigStructure(payload, externalAAD []byte) ([]byte, error) {
+	if payload == nil {
+		payload = s.Payload
+	}
+	return cbor.Dumps([]interface{}{
+		"Signature1",
+		nonNil(s.Protected),
+		nonNil(externalAAD),
+		nonNil(payload),
+	})
+}
+
+// Sign sets s.Signature by calling sign with the Sig_structure. payload is
+// only needed for a detached payload.
+func (s *Sign1) Sign(payload, externalAAD []byte, sign func(toBeSigned []byte) ([]byte, error)) error {
+	tbs, err := s.SigStructure(payload, externalAAD)
+	if err != nil {
+		return err
+	}
+	sig, err := sign(tbs)
+	if err != nil {
+		return err
+	}
+	s.Signature = sig
+	return nil
+}
+
+// Verify calls verify with the Sig_structure and s.Signature, returning
+// its error. payload is only needed for a detached payload.
+func (s *Sign1) Verify(payload, externalAAD []byte, verify func(toBeSigned, signature []byte) error) error {
+	tbs, err := s.SigStructure(payload, externalAAD)
+	if err != nil {
+		return err
+	}
+	return verify(tbs, s.Signature)
+}
+
+// Encode the message as tag 18 around
+//
+//	[protected, unprotected, payload / null, signature]
+func (s Sign1) ToCBOR(w io.Writer, enc *cbor.Encoder) error {
+	_, err := w.Write(cbor.EncodeInt(cbor.MajorTypeTag, TagSign1, nil))
+	if err != nil {
+		return err
+	}
+	unprotected := s.Unprotected
+	if unprotected == nil {
+		unprotected = map[interface{}]interface{}{}
+	}
+	var payload interface{}
+	if s.Payload != nil {
+		payload = s.Payload
+	}
+	return enc.Encode([]interface{}{nonNil(s.Protected), unprotected, payload, nonNil(s.Signature)})
+}
+
+// Decode a message, tagged with 18 or untagged.
+func (s *Sign1) FromCBOR(v interface{}) error {
+	if t, ok := v.(*cbor.CBORTag); ok {
+		if t.Tag != TagSign1 {
+			return fmt.Errorf("cose: expected tag %d for COSE_Sign1, got %d", TagSign1, t.Tag)
+		}
+		v = t.WrappedObject
+	}
+	parts, ok := v.([]interface{})
+	if !ok || len(parts) != 4 {
+		return errors.New("cose: COSE_Sign1 must be a 4 element array")
+	}
+	protected, ok := parts[0].([]byte)
+	if !ok {
+		return errors.New("cose: protected header must be a byte string")
+	}
+	unprotected, ok := parts[1].(map[interface{}]interface{})
+	if !ok {
+		return errors.New("cose: unprotected header must be a map")
+	}
+	var payload []byte
+	if parts[2] != nil {
+		payload, ok = parts[2].([]byte)
+		if !ok {
+			return errors.New("cose: payload must be a byte string or null")
+		}
+	}
+	sig, ok := parts[3].([]byte)
+	if !ok {
+		return errors.New("cose: signature must be a byte string")
+	}
+	if len(protected) == 0 {
+		protected = nil
+	}
+	*s = Sign1{Protected: protected, Unprotected: unprotected, Payload: payload, Signature: sig}
+	return nil
+}
+
+// Marshal encodes the message.
+func (s *Sign1) Marshal() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := cbor.Encode(buf, *s)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a message from blob.
+func (s *Sign1) Unmarshal(blob []byte) error {
+	return cbor.Loads(blob, s)
+}
+
+// byte strings are written as bstr even when empty, never as null
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
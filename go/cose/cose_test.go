@@ -0,0 +1,115 @@
+package cose
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestSigStructure(t *testing.T) {
+	protected, err := EncodeHeaders(map[interface{}]interface{}{HeaderAlgorithm: AlgES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(protected) != "a10126" {
+		t.Fatalf("protected headers encoded as %x", protected)
+	}
+	msg := Sign1{Protected: protected, Payload: []byte("hi")}
+	tbs, err := msg.SigStructure(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ["Signature1", h'a10126', h'', h'6869']
+	expected := "846a5369676e61747572653143a1012640426869"
+	if hex.EncodeToString(tbs) != expected {
+		t.Errorf("got %x, wanted %s", tbs, expected)
+	}
+
+	empty, _ := EncodeHeaders(nil)
+	if empty != nil {
+		t.Errorf("empty headers encoded as %x", empty)
+	}
+}
+
+func TestSign1RoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected, _ := EncodeHeaders(map[interface{}]interface{}{HeaderAlgorithm: AlgEdDSA})
+	msg := Sign1{
+		Protected:   protected,
+		Unprotected: map[interface{}]interface{}{HeaderKeyID: []byte("11")},
+		Payload:     []byte("This is the content."),
+	}
+	aad := []byte("context")
+	err = msg.Sign(nil, aad, func(tbs []byte) ([]byte, error) {
+		return ed25519.Sign(priv, tbs), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(blob, []byte{0xd2, 0x84, 0x43, 0xa1, 0x01, 0x27}) {
+		t.Errorf("unexpected encoding %x", blob)
+	}
+
+	var got Sign1
+	err = got.Unmarshal(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Payload, msg.Payload) || !bytes.Equal(got.Protected, protected) {
+		t.Errorf("got %#v", got)
+	}
+	if kid, _ := got.Unprotected[uint64(HeaderKeyID)].([]byte); string(kid) != "11" {
+		t.Errorf("bad unprotected headers %#v", got.Unprotected)
+	}
+	h, err := got.ProtectedHeaders()
+	if err != nil || h[uint64(HeaderAlgorithm)] != AlgEdDSA {
+		t.Errorf("bad protected headers %#v %v", h, err)
+	}
+
+	verify := func(tbs, sig []byte) error {
+		if !ed25519.Verify(pub, tbs, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	if err := got.Verify(nil, aad, verify); err != nil {
+		t.Error(err)
+	}
+	if err := got.Verify(nil, []byte("other"), verify); err == nil {
+		t.Error("signature verified with the wrong external AAD")
+	}
+}
+
+func TestSign1Detached(t *testing.T) {
+	msg := Sign1{Signature: []byte{1}}
+	blob, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 18([h'', {}, null, h'01'])
+	if hex.EncodeToString(blob) != "d28440a0f64101" {
+		t.Errorf("got %x", blob)
+	}
+	var got Sign1
+	err = got.Unmarshal(blob)
+	if err != nil || got.Payload != nil || got.Protected != nil {
+		t.Errorf("got %#v %v", got, err)
+	}
+	tbs, _ := got.SigStructure([]byte("detached"), nil)
+	if !bytes.HasSuffix(tbs, []byte("detached")) {
+		t.Errorf("detached payload not signed: %x", tbs)
+	}
+
+	if err := got.Unmarshal([]byte{0xd3, 0x80}); err == nil {
+		t.Error("expected error for the wrong tag")
+	}
+}
@@ -20,5 +20,21 @@ This might generate json:
 And CBOR equivalent to:
 {"serialization_name":"foo", "cbor_name":2}
 
+A struct can instead be serialized as a CBOR array of its fields, in declaration order, by adding a blank field tagged `cbor:",toarray"`. This is the compact form used by protocols such as COSE:
+
+  type Point struct {
+    _ struct{} `cbor:",toarray"`
+    X int
+    Y int
+  }
+
+The "omitempty" option leaves a field out of the map when it is false, 0, an empty string, array, slice or map, or a nil pointer or interface. Only the pointer itself is tested: a non-nil *bool pointing to false is still written, so optional fields whose zero value is meaningful should be pointers.
+
+The "pairs" option writes a map field as a CBOR array of alternating keys and values, [k1, v1, k2, v2, ...], for schemas which use that form to fix the order of entries. Such a field decodes from either form.
+
+The "default=" option gives the value a field takes when it is decoded from a CBOR map which lacks its key, e.g. `cbor:"port,default=8080"`. The text is converted to the field's type, or to what it points at: strings are taken as is, bools and numbers are parsed with strconv, a time.Duration with time.ParseDuration, and any other type must implement encoding.TextUnmarshaler. The text runs to the next comma, so it can't contain one. Encoding ignores the option.
+
+As with encoding/json, the fields of an embedded struct without a tag name are promoted into the outer struct. When names collide the shallowest field wins, then a tagged one; otherwise none of them is used. A named struct or struct pointer field with the "inline" option, `cbor:",inline"`, is flattened the same way.
+
 */
 package cbor
@@ -0,0 +1,97 @@
+package cbor
+
+import (
+	"io"
+	"math/big"
+)
+
+// EventHandler receives the items of a CBOR stream from an EventDecoder as
+// they are read, without Go values being built for them. Returning an
+// error from any method stops decoding.
+type EventHandler interface {
+	OnUint(u uint64) error
+	OnInt(i int64) error
+	OnBignum(x *big.Int) error
+	OnFloat(f float64) error
+	OnBytes(b []byte) error
+	OnString(s string) error
+	OnBool(b bool) error
+	OnNil() error
+
+	// An array starts. length is a capacity hint, 0 for an
+	// indefinite-length array.
+	OnArrayStart(length int) error
+
+	// A map starts. Its keys and values follow as alternating items.
+	OnMapStart() error
+
+	// The innermost open array or map ended.
+	OnBreak() error
+
+	// A tag; the tagged item follows as the next event.
+	OnTag(n uint64) error
+}
+
+// EventDecoder reads CBOR items and reports them to an EventHandler,
+// which lets huge documents be filtered or transformed in bounded memory.
+type EventDecoder struct {
+	dec *Decoder
+	ev  eventValue
+}
+
+// Return new EventDecoder reading from r and reporting to h.
+func NewEventDecoder(r io.Reader, h EventHandler) *EventDecoder {
+	return &EventDecoder{NewDecoder(r), eventValue{h}}
+}
+
+// Read one complete top-level item, reporting all of it to the handler.
+// Returns io.EOF when there are no more items.
+func (ed *EventDecoder) Decode() error {
+	return ed.dec.DecodeAny(&ed.ev)
+}
+
+// eventValue implements DecodeValue, DecodeValueMap and DecodeValueArray
+// by forwarding everything to an EventHandler.
+type eventValue struct {
+	h EventHandler
+}
+
+func (e *eventValue) Prepare() error                      { return nil }
+func (e *eventValue) SetBytes(buf []byte) error           { return e.h.OnBytes(buf) }
+func (e *eventValue) SetBignum(x *big.Int) error          { return e.h.OnBignum(x) }
+func (e *eventValue) SetUint(u uint64) error              { return e.h.OnUint(u) }
+func (e *eventValue) SetInt(i int64) error                { return e.h.OnInt(i) }
+func (e *eventValue) SetFloat32(f float32) error          { return e.h.OnFloat(float64(f)) }
+func (e *eventValue) SetFloat64(d float64) error          { return e.h.OnFloat(d) }
+func (e *eventValue) SetNil() error                       { return e.h.OnNil() }
+func (e *eventValue) SetBool(b bool) error                { return e.h.OnBool(b) }
+func (e *eventValue) SetString(s string) error            { return e.h.OnString(s) }
+func (e *eventValue) CreateMapKey() (DecodeValue, error)  { return e, nil }
+func (e *eventValue) SetMap(key, val DecodeValue) error   { return nil }
+func (e *eventValue) EndMap() error                       { return e.h.OnBreak() }
+func (e *eventValue) AppendArray(value DecodeValue) error { return nil }
+func (e *eventValue) EndArray() error                     { return e.h.OnBreak() }
+
+func (e *eventValue) CreateMap() (DecodeValueMap, error) {
+	return e, e.h.OnMapStart()
+}
+
+func (e *eventValue) CreateMapValue(key DecodeValue) (DecodeValue, error) {
+	return e, nil
+}
+
+func (e *eventValue) CreateArray(makeLength int) (DecodeValueArray, error) {
+	return e, e.h.OnArrayStart(makeLength)
+}
+
+func (e *eventValue) GetArrayValue(index uint64) (DecodeValue, error) {
+	return e, nil
+}
+
+func (e *eventValue) CreateTag(aux uint64, decoder TagDecoder) (DecodeValue, interface{}, error) {
+	return e, nil, e.h.OnTag(aux)
+}
+
+func (e *eventValue) SetTag(aux uint64, v DecodeValue, decoder TagDecoder, i interface{}) error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// records every event as a line of text
+type recordingHandler struct {
+	events []string
+}
+
+func (h *recordingHandler) add(format string, args ...interface{}) error {
+	h.events = append(h.events, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (h *recordingHandler) OnUint(u uint64) error         { return h.add("uint %d", u) }
+func (h *recordingHandler) OnInt(i int64) error           { return h.add("int %d", i) }
+func (h *recordingHandler) OnBignum(x *big.Int) error     { return h.add("bignum %s", x) }
+func (h *recordingHandler) OnFloat(f float64) error       { return h.add("float %v", f) }
+func (h *recordingHandler) OnBytes(b []byte) error        { return h.add("bytes %x", b) }
+func (h *recordingHandler) OnString(s string) error       { return h.add("string %s", s) }
+func (h *recordingHandler) OnBool(b bool) error           { return h.add("bool %v", b) }
+func (h *recordingHandler) OnNil() error                  { return h.add("nil") }
+func (h *recordingHandler) OnArrayStart(length int) error { return h.add("array %d", length) }
+func (h *recordingHandler) OnMapStart() error             { return h.add("map") }
+func (h *recordingHandler) OnBreak() error                { return h.add("break") }
+func (h *recordingHandler) OnTag(n uint64) error          { return h.add("tag %d", n) }
+
+func TestEventDecoder(t *testing.T) {
+	// {"a": [1, -2, 1.5, true, null], "b": h'0102', "c": 32("x")}
+	// followed by [_ "y"] and 2(h'010000000000000000')
+	blob, _ := hex.DecodeString(
+		"a36161850121f93e00f5f6" +
+			"61624201026163d8206178" +
+			"9f6179ff" +
+			"c249010000000000000000")
+	h := &recordingHandler{}
+	ed := NewEventDecoder(bytes.NewReader(blob), h)
+	for {
+		err := ed.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		"map",
+		"string a", "array 5", "uint 1", "int -2", "float 1.5", "bool true", "nil", "break",
+		"string b", "bytes 0102",
+		"string c", "tag 32", "string x",
+		"break",
+		"array 0", "string y", "break",
+		"bignum 18446744073709551616",
+	}
+	if strings.Join(h.events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("wanted events:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(h.events, "\n"))
+	}
+}
@@ -0,0 +1,169 @@
+package cbor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// LengthFormat is how the length prefix of a frame is written.
+type LengthFormat int
+
+const (
+	// An unsigned varint, as encoding/binary.PutUvarint writes.
+	LengthUvarint LengthFormat = iota
+
+	// A 2 byte big-endian length.
+	LengthUint16
+
+	// A 4 byte big-endian length.
+	LengthUint32
+)
+
+// FrameReader reads CBOR items which are each prefixed with their length
+// in bytes, as some protocols send them. Every frame must hold exactly
+// one item.
+type FrameReader struct {
+	r      *bufio.Reader
+	format LengthFormat
+
+	// Largest frame accepted. Zero means no limit.
+	MaxFrameLen int
+
+	// If set, called with the Decoder made for each frame to set options
+	// such as TagDecoders or MaxElements.
+	Configure func(dec *Decoder)
+}
+
+// Return a FrameReader reading frames with the given length prefix from r.
+func NewFrameReader(r io.Reader, format LengthFormat) *FrameReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &FrameReader{r: br, format: format}
+}
+
+// Decode the next frame into v. It returns io.EOF when the stream ends
+// cleanly between frames. On an error within a frame, including an empty
+// frame, one over MaxFrameLen, or an item shorter or longer than its
+// frame, the rest of the frame is skipped so the following frame can
+// still be read. After an error reading the length prefix itself the
+// position in the stream is lost.
+func (fr *FrameReader) Decode(v interface{}) error {
+	n, err := fr.readLength()
+	if err != nil {
+		return err
+	}
+	if n > 1<<62 {
+		return fmt.Errorf("cbor: frame length %d out of range", n)
+	}
+	if n == 0 {
+		return fmt.Errorf("cbor: empty frame")
+	}
+	if fr.MaxFrameLen > 0 && n > uint64(fr.MaxFrameLen) {
+		_, err = io.CopyN(io.Discard, fr.r, int64(n))
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("cbor: frame of %d bytes exceeds MaxFrameLen %d", n, fr.MaxFrameLen)
+	}
+
+	body := &frameBody{r: fr.r, n: int64(n)}
+	dec := NewUnbufferedDecoder(body)
+	if fr.Configure != nil {
+		fr.Configure(dec)
+	}
+	err = dec.Decode(v)
+	used := dec.BytesRead()
+	if body.n != 0 {
+		_, skipErr := io.CopyN(io.Discard, fr.r, body.n)
+		if skipErr != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = fmt.Errorf("cbor: frame of %d bytes holds a %d byte item", n, used)
+		}
+	}
+	return err
+}
+
+func (fr *FrameReader) readLength() (uint64, error) {
+	switch fr.format {
+	case LengthUvarint:
+		return binary.ReadUvarint(fr.r)
+	case LengthUint16, LengthUint32:
+		size := 2
+		if fr.format == LengthUint32 {
+			size = 4
+		}
+		var buf [4]byte
+		_, err := io.ReadFull(fr.r, buf[:size])
+		if err != nil {
+			return 0, err
+		}
+		if size == 2 {
+			return uint64(binary.BigEndian.Uint16(buf[:2])), nil
+		}
+		return uint64(binary.BigEndian.Uint32(buf[:4])), nil
+	}
+	return 0, fmt.Errorf("cbor: unknown frame length format %d", fr.format)
+}
+
+// The remaining bytes of a frame, readable a byte at a time so the
+// Decoder doesn't need to buffer.
+type frameBody struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (fb *frameBody) Read(p []byte) (int, error) {
+	if fb.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > fb.n {
+		p = p[:fb.n]
+	}
+	n, err := fb.r.Read(p)
+	fb.n -= int64(n)
+	return n, err
+}
+
+func (fb *frameBody) ReadByte() (byte, error) {
+	if fb.n <= 0 {
+		return 0, io.EOF
+	}
+	b, err := fb.r.ReadByte()
+	if err == nil {
+		fb.n--
+	}
+	return b, err
+}
+
+// WriteFrame encodes v and writes it to w prefixed with its length.
+func WriteFrame(w io.Writer, format LengthFormat, v interface{}) error {
+	blob, err := Dumps(v)
+	if err != nil {
+		return err
+	}
+	var prefix []byte
+	switch format {
+	case LengthUvarint:
+		prefix = binary.AppendUvarint(nil, uint64(len(blob)))
+	case LengthUint16:
+		if len(blob) > 0xffff {
+			return fmt.Errorf("cbor: %d byte item too long for a 2 byte frame length", len(blob))
+		}
+		prefix = binary.BigEndian.AppendUint16(nil, uint16(len(blob)))
+	case LengthUint32:
+		if uint64(len(blob)) > 0xffffffff {
+			return fmt.Errorf("cbor: %d byte item too long for a 4 byte frame length", len(blob))
+		}
+		prefix = binary.BigEndian.AppendUint32(nil, uint32(len(blob)))
+	default:
+		return fmt.Errorf("cbor: unknown frame length format %d", format)
+	}
+	_, err = w.Write(append(prefix, blob...))
+	return err
+}
@@ -0,0 +1,82 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestFrameReader(t *testing.T) {
+	for _, format := range []LengthFormat{LengthUvarint, LengthUint16, LengthUint32} {
+		buf := new(bytes.Buffer)
+		items := []interface{}{"hello", uint64(7), []interface{}{uint64(1), "two"}}
+		for _, it := range items {
+			err := WriteFrame(buf, format, it)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		fr := NewFrameReader(buf, format)
+		for i, want := range items {
+			var got interface{}
+			err := fr.Decode(&got)
+			if err != nil {
+				t.Fatalf("format %d frame %d: %v", format, i, err)
+			}
+			if hex.EncodeToString(mustDumps(t, got)) != hex.EncodeToString(mustDumps(t, want)) {
+				t.Errorf("format %d frame %d: got %#v, wanted %#v", format, i, got, want)
+			}
+		}
+		var end interface{}
+		if err := fr.Decode(&end); err != io.EOF {
+			t.Errorf("format %d: expected io.EOF, got %v", format, err)
+		}
+	}
+}
+
+func mustDumps(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	blob, err := Dumps(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestFrameReaderMismatch(t *testing.T) {
+	// frame of 3 holding a 1 byte item, frame of 1 with a truncated
+	// 2 byte item, then a good frame
+	blob, _ := hex.DecodeString("0301020301180107")
+	fr := NewFrameReader(bytes.NewReader(blob), LengthUvarint)
+	var x uint64
+	if err := fr.Decode(&x); err == nil {
+		t.Error("expected error for item shorter than its frame")
+	}
+	if err := fr.Decode(&x); err == nil {
+		t.Error("expected error for item longer than its frame")
+	}
+	if err := fr.Decode(&x); err != nil || x != 7 {
+		t.Errorf("frames out of step: got %d %v", x, err)
+	}
+
+	// a frame over MaxFrameLen is skipped, not read as frames
+	blob, _ = hex.DecodeString("0561616161610107")
+	fr = NewFrameReader(bytes.NewReader(blob), LengthUvarint)
+	fr.MaxFrameLen = 4
+	if err := fr.Decode(&x); err == nil {
+		t.Error("expected MaxFrameLen error")
+	}
+	if err := fr.Decode(&x); err != nil || x != 7 {
+		t.Errorf("after MaxFrameLen: got %d %v", x, err)
+	}
+
+	// an empty frame is an error, not the end of the stream
+	fr = NewFrameReader(bytes.NewReader([]byte{0x00, 0x01, 0x01}), LengthUvarint)
+	if err := fr.Decode(&x); err == nil || err == io.EOF {
+		t.Errorf("expected empty frame error, got %v", err)
+	}
+	if err := fr.Decode(&x); err != nil || x != 1 {
+		t.Errorf("after empty frame: got %d %v", x, err)
+	}
+}
@@ -0,0 +1,207 @@
+package cbor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/url"
+	"reflect"
+)
+
+// TranscodeJSON converts a stream of JSON values, such as newline
+// delimited JSON, into a CBOR sequence of the same values. Objects and
+// arrays are written as indefinite-length maps and arrays as their tokens
+// arrive, so memory use doesn't grow with the size of the input.
+//
+// Integers become CBOR integers, or bignums if they don't fit in 64 bits.
+// Other numbers become floats.
+func TranscodeJSON(w io.Writer, r io.Reader) error {
+	jd := json.NewDecoder(r)
+	jd.UseNumber()
+	enc := NewEncoder(w)
+	for {
+		tok, err := jd.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = transcodeToken(enc, tok)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write one JSON token. The json.Decoder checks that delimiters nest
+// properly, so each closing delimiter ends the innermost open container.
+func transcodeToken(enc *Encoder, tok json.Token) error {
+	switch x := tok.(type) {
+	case json.Delim:
+		switch x {
+		case '{':
+			return enc.StartIndefiniteMap()
+		case '[':
+			return enc.StartIndefiniteArray()
+		default:
+			return enc.EndIndefinite()
+		}
+	case json.Number:
+		return enc.writeNumber(Number(x))
+	case string:
+		return enc.writeText(x)
+	case bool:
+		return enc.writeBool(x)
+	case nil:
+		return enc.writeNull()
+	}
+	return fmt.Errorf("unexpected JSON token %#v", tok)
+}
+
+// DecodeToJSON converts the first CBOR item in data to JSON, e.g. for a
+// gateway passing CBOR payloads on to JSON clients. Byte strings become
+// base64 strings and bignums, decimals and UUIDs strings, so no precision
+// is lost. Map keys which aren't text strings are written as the text of
+// their JSON form, and unknown tags are dropped, leaving their content.
+// NaN and infinite floats, which JSON can't represent, are an error.
+// Numbers decoded as a Number or big.Float keep all their digits as JSON
+// numbers, and URIs decoded as a url.URL become their text.
+//
+// Decoding into a json.RawMessage converts the item the same way, under
+// the limits and TagDecoders of the Decoder. Two map keys with the same
+// JSON text, such as 1 and "1", are an error.
+func DecodeToJSON(data []byte) (json.RawMessage, error) {
+	var j json.RawMessage
+	err := Loads(data, &j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Decode the item starting with c and convert it to JSON.
+func (dec *Decoder) decodeJSON(c byte) (json.RawMessage, error) {
+	var v interface{}
+	outer := dec.orderedMaps
+	dec.orderedMaps = true
+	err := dec.innerDecodeC(&reflectValue{v: reflect.ValueOf(&v), dec: dec}, c)
+	dec.orderedMaps = outer
+	if err != nil {
+		return nil, err
+	}
+	jv, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jv)
+}
+
+// Convert a value decoded into an interface{} to one encoding/json
+// marshals as DecodeToJSON describes.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case big.Int:
+		return x.String(), nil
+	case *big.Int:
+		return x.String(), nil
+	case Decimal:
+		return x.String(), nil
+	case UUID:
+		return x.String(), nil
+	case Number:
+		f, err := x.Float64()
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("JSON can't represent the number %s", string(x))
+		}
+		return json.Number(x), nil
+	case big.Float:
+		return jsonBigFloat(&x)
+	case *big.Float:
+		return jsonBigFloat(x)
+	case url.URL:
+		return x.String(), nil
+	case *url.URL:
+		return x.String(), nil
+	case *CBORTag:
+		return jsonValue(x.WrappedObject)
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			je, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = je
+		}
+		return out, nil
+	case OrderedMap:
+		out := make(map[string]interface{}, len(x))
+		for _, item := range x {
+			err := addJSONEntry(out, item.Key, item.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			err := addJSONEntry(out, k, e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func jsonBigFloat(x *big.Float) (interface{}, error) {
+	if x.IsInf() {
+		return nil, fmt.Errorf("JSON can't represent the number %s", x.String())
+	}
+	return json.Number(x.Text('g', -1)), nil
+}
+
+// Add the converted key and value of a CBOR map entry to a JSON object.
+func addJSONEntry(out map[string]interface{}, k, v interface{}) error {
+	jk, err := jsonKey(k)
+	if err != nil {
+		return err
+	}
+	if _, dup := out[jk]; dup {
+		return fmt.Errorf("duplicate JSON key %q", jk)
+	}
+	jv, err := jsonValue(v)
+	if err != nil {
+		return err
+	}
+	out[jk] = jv
+	return nil
+}
+
+// Return the JSON object key for a CBOR map key.
+func jsonKey(k interface{}) (string, error) {
+	switch x := k.(type) {
+	case string:
+		return x, nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x), nil
+	}
+	jk, err := jsonValue(k)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := jk.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(jk)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,204 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTranscodeJSON(t *testing.T) {
+	in := `{"a": [1, -2, 1.5, 18446744073709551615, 18446744073709551616], "b": {"c": null, "d": true}}
+"two"
+[]
+`
+	buf := &bytes.Buffer{}
+	err := TranscodeJSON(buf, strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := NewDecoder(buf)
+	var first map[string]interface{}
+	err = dec.Decode(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := first["a"].([]interface{})
+	if a[0] != uint64(1) || a[1] != int64(-2) || a[2] != 1.5 || a[3] != uint64(18446744073709551615) {
+		t.Errorf("got %#v", a)
+	}
+	if bi, ok := a[4].(big.Int); !ok || bi.String() != "18446744073709551616" {
+		t.Errorf("got %#v", a)
+	}
+	b := first["b"].(map[interface{}]interface{})
+	if v, ok := b["c"]; !ok || v != nil || b["d"] != true {
+		t.Errorf("got %#v", b)
+	}
+	var second string
+	var third []interface{}
+	err = dec.DecodeSequence(&second, &third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != "two" || len(third) != 0 {
+		t.Errorf("got %#v %#v", second, third)
+	}
+	var rest interface{}
+	if err = dec.Decode(&rest); err != io.EOF {
+		t.Errorf("wanted io.EOF got %v", err)
+	}
+}
+
+func TestTranscodeJSONBytes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := TranscodeJSON(buf, strings.NewReader(`{"a": [1, "b"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {_ "a": [_ 1, "b"]}
+	if hex.EncodeToString(buf.Bytes()) != "bf61619f016162ffff" {
+		t.Errorf("got %x", buf.Bytes())
+	}
+
+	err = TranscodeJSON(&bytes.Buffer{}, strings.NewReader(`{"a": [1}`))
+	if err == nil {
+		t.Error("wanted error for malformed JSON")
+	}
+}
+
+func TestIndefiniteEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.StartIndefiniteArray()
+	enc.Encode(1)
+	enc.StartIndefiniteMap()
+	enc.Encode("x")
+	enc.Encode(2)
+	enc.EndIndefinite()
+	enc.EndIndefinite()
+
+	var out interface{}
+	err := Loads(buf.Bytes(), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{uint64(1), map[interface{}]interface{}{"x": uint64(2)}}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("wanted %#v got %#v", want, out)
+	}
+}
+
+func TestDecodeToJSON(t *testing.T) {
+	bn, _ := new(big.Int).SetString("18446744073709551616", 10)
+	in := map[interface{}]interface{}{
+		"bytes":   []byte{1, 2, 3},
+		"big":     bn,
+		"list":    []interface{}{uint64(1), int64(-2), 1.5, "x", nil, true},
+		"nested":  map[string]interface{}{"a": Decimal{Exp: -2, Mantissa: big.NewInt(314)}},
+		"tagged":  &CBORTag{Tag: 1000, WrappedObject: "inner"},
+		uint64(7): "seven",
+	}
+	blob, err := Dumps(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := DecodeToJSON(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"7":"seven","big":"18446744073709551616","bytes":"AQID",` +
+		`"list":[1,-2,1.5,"x",null,true],"nested":{"a":"314e-2"},"tagged":"inner"}`
+	if string(out) != expected {
+		t.Errorf("got %s", out)
+	}
+
+	blob, _ = hex.DecodeString("f97e00") // NaN
+	_, err = DecodeToJSON(blob)
+	if err == nil {
+		t.Error("expected an error for NaN")
+	}
+
+	// byte string keys are base64 like byte string values
+	blob, _ = hex.DecodeString("a142fffe01") // {h'fffe': 1}
+	out, err = DecodeToJSON(blob)
+	if err != nil || string(out) != `{"//4=":1}` {
+		t.Errorf("got %s %v", out, err)
+	}
+
+	// keys with the same JSON text
+	for _, h := range []string{
+		"a201616161316162", // {1: "a", "1": "b"}
+		"a2416101416102",   // {h'61': 1, h'61': 2}
+	} {
+		blob, _ = hex.DecodeString(h)
+		_, err = DecodeToJSON(blob)
+		if err == nil || !strings.Contains(err.Error(), "duplicate") {
+			t.Errorf("%s: expected duplicate key error, got %v", h, err)
+		}
+	}
+}
+
+func TestDecodeIntoJSONRawMessage(t *testing.T) {
+	type Envelope struct {
+		Kind string
+		Body json.RawMessage
+		Opt  *json.RawMessage
+	}
+	blob, err := Dumps(map[string]interface{}{
+		"Kind": "event",
+		"Body": map[string]interface{}{"id": 7, "raw": []byte("hi")},
+		"Opt":  []interface{}{1, "two"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env Envelope
+	err = Loads(blob, &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Kind != "event" || string(env.Body) != `{"id":7,"raw":"aGk="}` || env.Opt == nil || string(*env.Opt) != `[1,"two"]` {
+		t.Errorf("got %#v", env)
+	}
+
+	// the Decoder's limits apply to the item being converted
+	arr := []byte{0x99, 0x03, 0xe8}
+	for i := 0; i < 1000; i++ {
+		arr = append(arr, 0x01)
+	}
+	dec := NewDecoder(bytes.NewReader(arr))
+	dec.MaxElements = 10
+	var j json.RawMessage
+	if err := dec.Decode(&j); err == nil {
+		t.Errorf("expected MaxElements error, got %d bytes", len(j))
+	}
+}
+
+func TestDecodeToJSONWithOptions(t *testing.T) {
+	cases := []struct {
+		hex       string
+		configure func(dec *Decoder)
+		expected  string
+	}{
+		// {"a": 5, "b": 1.5}
+		{"a26161056162f93e00", func(dec *Decoder) { dec.UseNumber = true }, `{"a":5,"b":1.5}`},
+		{"a26161056162f93e00", func(dec *Decoder) { dec.FloatDecodeMode = FloatDecodeBigFloat }, `{"a":5,"b":1.5}`},
+		// 32("http://x/")
+		{"d82069687474703a2f2f782f", RegisterStandardTags, `"http://x/"`},
+	}
+	for _, c := range cases {
+		blob, _ := hex.DecodeString(c.hex)
+		dec := NewDecoder(bytes.NewReader(blob))
+		c.configure(dec)
+		var j json.RawMessage
+		err := dec.Decode(&j)
+		if err != nil || string(j) != c.expected {
+			t.Errorf("%s: got %s %v", c.hex, j, err)
+		}
+	}
+}
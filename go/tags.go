@@ -0,0 +1,202 @@
+package cbor
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// RegisterStandardTags installs TagDecoders on dec for the common
+// semantic tags of RFC 8949, in addition to the bignum (2, 3), decimal
+// (4) and UUID (37) handling every Decoder has:
+//
+//	0   RFC 3339 date/time string  -> time.Time
+//	1   epoch-based date/time      -> time.Time
+//	5   bigfloat [exp, mantissa]   -> *big.Float
+//	32  URI                        -> *url.URL
+//
+// TagDecoders already set for these tags are replaced.
+func RegisterStandardTags(dec *Decoder) {
+	if dec.TagDecoders == nil {
+		dec.TagDecoders = make(map[uint64]TagDecoder)
+	}
+	for _, td := range []TagDecoder{
+		dateTimeTagDecoder{},
+		epochTimeTagDecoder{},
+		decimalTagDecoder{},
+		bigfloatTagDecoder{},
+		uriTagDecoder{},
+		uuidTagDecoder{},
+	} {
+		dec.TagDecoders[td.GetTag()] = td
+	}
+}
+
+// Whether td is one of the TagDecoders RegisterStandardTags installs.
+func isStandardTagDecoder(td TagDecoder) bool {
+	switch td.(type) {
+	case dateTimeTagDecoder, epochTimeTagDecoder, decimalTagDecoder, bigfloatTagDecoder, uriTagDecoder, uuidTagDecoder:
+		return true
+	}
+	return false
+}
+
+// RegisterStandardTagEncoders installs TagEncoders on enc which write
+// the types RegisterStandardTags decodes under their tags: time.Time as
+// tag 0, url.URL and *url.URL as tag 32, and big.Float and *big.Float as
+// tag 5. Bignums, Decimal and UUID are always tagged.
+func RegisterStandardTagEncoders(enc *Encoder) {
+	if enc.TagEncoders == nil {
+		enc.TagEncoders = make(map[reflect.Type]TagEncoder)
+	}
+	enc.TagEncoders[reflect.TypeOf(time.Time{})] = dateTimeTagEncoder{}
+	enc.TagEncoders[reflect.TypeOf(url.URL{})] = uriTagEncoder{}
+	enc.TagEncoders[reflect.TypeOf((*url.URL)(nil))] = uriTagEncoder{}
+	enc.TagEncoders[reflect.TypeOf(big.Float{})] = bigfloatTagEncoder{}
+	enc.TagEncoders[reflect.TypeOf((*big.Float)(nil))] = bigfloatTagEncoder{}
+}
+
+// TagDecoder for tag 0.
+type dateTimeTagDecoder struct{}
+
+func (dateTimeTagDecoder) GetTag() uint64 { return tagDateTime }
+
+func (dateTimeTagDecoder) DecodeTarget() interface{} { return new(string) }
+
+func (dateTimeTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	t, err := time.Parse(time.RFC3339Nano, *(v.(*string)))
+	if err != nil {
+		return nil, fmt.Errorf("date/time tag 0: %v", err)
+	}
+	return t, nil
+}
+
+// TagDecoder for tag 1.
+type epochTimeTagDecoder struct{}
+
+func (epochTimeTagDecoder) GetTag() uint64 { return tagEpochTime }
+
+func (epochTimeTagDecoder) DecodeTarget() interface{} { return new(interface{}) }
+
+func (epochTimeTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	switch x := (*(v.(*interface{}))).(type) {
+	case uint64:
+		if x > math.MaxInt64 {
+			return nil, fmt.Errorf("epoch time %d out of range", x)
+		}
+		return time.Unix(int64(x), 0), nil
+	case int64:
+		return time.Unix(x, 0), nil
+	case float32:
+		return epochFloat(float64(x))
+	case float64:
+		return epochFloat(x)
+	case Number:
+		if i, err := x.Int64(); err == nil {
+			return time.Unix(i, 0), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return epochFloat(f)
+	default:
+		return nil, fmt.Errorf("epoch time tag 1 must hold a number, got %T", x)
+	}
+}
+
+func epochFloat(f float64) (time.Time, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxInt64/2 {
+		return time.Time{}, fmt.Errorf("epoch time %v out of range", f)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// TagDecoder for tag 5.
+type bigfloatTagDecoder struct{}
+
+func (bigfloatTagDecoder) GetTag() uint64 { return tagBigfloat }
+
+func (bigfloatTagDecoder) DecodeTarget() interface{} { return new([]interface{}) }
+
+func (bigfloatTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	parts := *(v.(*[]interface{}))
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bigfloat tag 5 must hold [exponent, mantissa], got %d items", len(parts))
+	}
+	exp, m, err := expMantissa(parts, "bigfloat")
+	if err != nil {
+		return nil, err
+	}
+	if exp < big.MinExp || exp > big.MaxExp {
+		return nil, fmt.Errorf("bigfloat exponent %d out of range", exp)
+	}
+	f := new(big.Float).SetInt(m)
+	return f.SetMantExp(f, int(exp)), nil
+}
+
+// TagDecoder for tag 32.
+type uriTagDecoder struct{}
+
+func (uriTagDecoder) GetTag() uint64 { return tagURI }
+
+func (uriTagDecoder) DecodeTarget() interface{} { return new(string) }
+
+func (uriTagDecoder) PostDecode(v interface{}) (interface{}, error) {
+	return url.Parse(*(v.(*string)))
+}
+
+// TagEncoder writing time.Time as tag 0.
+type dateTimeTagEncoder struct{}
+
+func (dateTimeTagEncoder) GetTag() uint64 { return tagDateTime }
+
+func (dateTimeTagEncoder) PreEncode(v interface{}) (interface{}, error) {
+	return v.(time.Time).Format(time.RFC3339Nano), nil
+}
+
+// TagEncoder writing url.URL and *url.URL as tag 32.
+type uriTagEncoder struct{}
+
+func (uriTagEncoder) GetTag() uint64 { return tagURI }
+
+func (uriTagEncoder) PreEncode(v interface{}) (interface{}, error) {
+	switch u := v.(type) {
+	case *url.URL:
+		return u.String(), nil
+	case url.URL:
+		return u.String(), nil
+	}
+	return nil, fmt.Errorf("cannot encode %T as a URI", v)
+}
+
+// TagEncoder writing big.Float and *big.Float as tag 5.
+type bigfloatTagEncoder struct{}
+
+func (bigfloatTagEncoder) GetTag() uint64 { return tagBigfloat }
+
+func (bigfloatTagEncoder) PreEncode(v interface{}) (interface{}, error) {
+	var f *big.Float
+	switch x := v.(type) {
+	case *big.Float:
+		f = x
+	case big.Float:
+		f = &x
+	default:
+		return nil, fmt.Errorf("cannot encode %T as a bigfloat", v)
+	}
+	if f.IsInf() {
+		return nil, fmt.Errorf("cannot encode infinite bigfloat")
+	}
+	// f = mant * 2^exp with 0.5 <= |mant| < 1, shifted to an integer
+	mant := new(big.Float)
+	exp := f.MantExp(mant)
+	prec := mant.MinPrec()
+	mant.SetMantExp(mant, int(prec))
+	m, _ := mant.Int(nil)
+	return []interface{}{int64(exp) - int64(prec), m}, nil
+}
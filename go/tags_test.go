@@ -0,0 +1,120 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func decodeStandard(t *testing.T, h string, v interface{}) {
+	t.Helper()
+	blob, _ := hex.DecodeString(h)
+	dec := NewDecoder(bytes.NewReader(blob))
+	RegisterStandardTags(dec)
+	err := dec.Decode(v)
+	if err != nil {
+		t.Fatalf("%s: %v", h, err)
+	}
+}
+
+func TestStandardTagDecoders(t *testing.T) {
+	// examples from RFC 8949 appendix A
+	var tm time.Time
+	decodeStandard(t, "c074323031332d30332d32315432303a30343a30305a", &tm)
+	if !tm.Equal(time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)) {
+		t.Errorf("tag 0 decoded to %v", tm)
+	}
+	decodeStandard(t, "c11a514b67b0", &tm)
+	if !tm.Equal(time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)) {
+		t.Errorf("tag 1 decoded to %v", tm)
+	}
+	decodeStandard(t, "c1fb41d452d9ec200000", &tm)
+	if !tm.Equal(time.Date(2013, 3, 21, 20, 4, 0, 500000000, time.UTC)) {
+		t.Errorf("tag 1 float decoded to %v", tm)
+	}
+
+	var u *url.URL
+	decodeStandard(t, "d82076687474703a2f2f7777772e6578616d706c652e636f6d", &u)
+	if u == nil || u.Host != "www.example.com" {
+		t.Errorf("tag 32 decoded to %v", u)
+	}
+
+	// 5([-1, 3]) is 1.5
+	var f *big.Float
+	decodeStandard(t, "c5822003", &f)
+	if f == nil || f.Cmp(big.NewFloat(1.5)) != 0 {
+		t.Errorf("tag 5 decoded to %v", f)
+	}
+
+	var any interface{}
+	decodeStandard(t, "c11a514b67b0", &any)
+	if _, ok := any.(time.Time); !ok {
+		t.Errorf("tag 1 into interface{} gave %T", any)
+	}
+
+	// tags 4 and 5 with their parts decoded as Numbers
+	for _, h := range []string{"c48221196ab3", "c5822003"} {
+		blob, _ := hex.DecodeString(h)
+		dec := NewDecoder(bytes.NewReader(blob))
+		RegisterStandardTags(dec)
+		dec.UseNumber = true
+		var v interface{}
+		err := dec.Decode(&v)
+		if err != nil {
+			t.Errorf("%s: %v", h, err)
+			continue
+		}
+		switch x := v.(type) {
+		case Decimal:
+			if x.String() != "27315e-2" {
+				t.Errorf("%s: got %s", h, x)
+			}
+		case *big.Float:
+			if x.Cmp(big.NewFloat(1.5)) != 0 {
+				t.Errorf("%s: got %s", h, x)
+			}
+		default:
+			t.Errorf("%s: got %T", h, v)
+		}
+	}
+}
+
+func TestStandardTagEncoders(t *testing.T) {
+	type Record struct {
+		When  time.Time
+		Link  *url.URL
+		Value *big.Float
+		None  *url.URL
+	}
+	link, _ := url.Parse("https://example.com/a?b=c")
+	in := Record{
+		When:  time.Date(2013, 3, 21, 20, 4, 0, 250, time.UTC),
+		Link:  link,
+		Value: big.NewFloat(-0.09375),
+	}
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	RegisterStandardTagEncoders(enc)
+	err := enc.Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 5([-5, -3]) for -3 * 2^-5
+	if !bytes.Contains(buf.Bytes(), []byte{0xc5, 0x82, 0x24, 0x22}) {
+		t.Errorf("bigfloat not written as expected in %x", buf.Bytes())
+	}
+
+	var out Record
+	dec := NewDecoder(buf)
+	RegisterStandardTags(dec)
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.When.Equal(in.When) || out.Link.String() != link.String() || out.Value.Cmp(in.Value) != 0 || out.None != nil {
+		t.Errorf("got %#v, wanted %#v", out, in)
+	}
+}